@@ -0,0 +1,87 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// bearerProfile is the bearer profile used by the application services (NTP, HTTP and FTP).
+const bearerProfile = 1
+
+type BearerStatus string
+
+const BearerConnecting BearerStatus = "0"
+const BearerConnected BearerStatus = "1"
+const BearerClosing BearerStatus = "2"
+const BearerClosed BearerStatus = "3"
+
+var bearerQueryRegexp = regexp.MustCompile(`^\+SAPBR: [0-9]+,([0-9]),"([^"]*)"$`)
+
+// OpenBearer configures the GPRS bearer used by the module's application services with the configured APN, and
+// opens it if it is not open yet.
+func (g *DefaultGsmModule) OpenBearer() error {
+	status, _, err := g.GetBearerStatus()
+	if err != nil {
+		return err
+	}
+	if status == BearerConnected {
+		return nil
+	}
+	apn := getConfigValue(APNConfig, g.configs...).(APN)
+	err = g.executeATCommand(fmt.Sprintf(string(BearerConfigCommand), bearerProfile, "Contype", "GPRS"))
+	if err != nil {
+		return errors.New("could not configure bearer:" + err.Error())
+	}
+	err = g.executeATCommand(fmt.Sprintf(string(BearerConfigCommand), bearerProfile, "APN", apn))
+	if err != nil {
+		return errors.New("could not configure bearer:" + err.Error())
+	}
+	// opening the bearer can take up to 85 seconds
+	err = g.sendCommand(fmt.Sprintf(string(BearerOpenCommand), bearerProfile))
+	if err != nil {
+		return errors.New("could not open bearer:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf("^(%s|%s)$",
+		string(OkResponse),
+		string(ErrorResponse))), 85*time.Second)
+	if err != nil {
+		return errors.New("could not open bearer:" + err.Error())
+	}
+	if m != string(OkResponse) {
+		return errors.New("could not open bearer")
+	}
+	return nil
+}
+
+// CloseBearer closes the GPRS bearer used by the module's application services.
+func (g *DefaultGsmModule) CloseBearer() error {
+	err := g.executeATCommand(fmt.Sprintf(string(BearerCloseCommand), bearerProfile))
+	if err != nil {
+		return errors.New("could not close bearer:" + err.Error())
+	}
+	return nil
+}
+
+// GetBearerStatus queries the status and IP address of the GPRS bearer used by the module's application services.
+func (g *DefaultGsmModule) GetBearerStatus() (BearerStatus, string, error) {
+	err := g.sendCommand(fmt.Sprintf(string(BearerQueryCommand), bearerProfile))
+	if err != nil {
+		return "", "", errors.New("could not query bearer:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+SAPBR: .*|%s)$`,
+		string(ErrorResponse))), 5*time.Second)
+	if err != nil {
+		return "", "", errors.New("could not query bearer:" + err.Error())
+	}
+	s := bearerQueryRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return "", "", errors.New("could not query bearer: " + m)
+	}
+	_, err = g.waitForLine(okRegexp, 5*time.Second)
+	if err != nil {
+		return "", "", err
+	}
+	return BearerStatus(s[1]), s[2], nil
+}
@@ -0,0 +1,155 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// clockLayout is the layout of the module clock, excluding the time zone.
+const clockLayout = "06/01/02,15:04:05"
+
+// quarterHour is the resolution of the module's time zones.
+const quarterHour = 15 * time.Minute
+
+var clockRegexp = regexp.MustCompile(`^\+CCLK: "([0-9]{2}/[0-9]{2}/[0-9]{2},[0-9]{2}:[0-9]{2}:[0-9]{2})([+-][0-9]{1,2})"$`)
+var networkTimeRegexp = regexp.MustCompile(`^\+CNTP: ([0-9]+)`)
+
+var networkTimeErrors = map[string]string{
+	"61": "network error",
+	"62": "DNS resolution error",
+	"63": "connection error",
+	"64": "service response error",
+	"65": "service response timeout",
+}
+
+// SyncNetworkTime synchronises the module clock with the given NTP server (AT+CNTP). The clock is set to the time
+// zone with the given offset from UTC, which is rounded to quarter hours. On SIM800 and SIM7000 modules the GPRS
+// bearer is opened if necessary.
+func (g *DefaultGsmModule) SyncNetworkTime(server string, utcOffset time.Duration) error {
+	success := "1"
+	if g.model() == SIM7600 {
+		success = "0"
+	} else {
+		err := g.OpenBearer()
+		if err != nil {
+			return err
+		}
+		err = g.executeATCommand(fmt.Sprintf(string(NetworkTimeBearerCommand), bearerProfile))
+		if err != nil {
+			return errors.New("could not set network time bearer:" + err.Error())
+		}
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(NetworkTimeServerCommand), server, int(utcOffset/quarterHour)))
+	if err != nil {
+		return errors.New("could not set network time server:" + err.Error())
+	}
+	err = g.sendCommand(string(NetworkTimeSyncCommand))
+	if err != nil {
+		return errors.New("could not synchronise network time:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+CNTP: .*|%s)$`,
+		string(ErrorResponse))), 60*time.Second)
+	if err != nil {
+		return errors.New("could not synchronise network time:" + err.Error())
+	}
+	s := networkTimeRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return errors.New("could not synchronise network time: " + m)
+	}
+	if s[1] != success {
+		if msg, ok := networkTimeErrors[s[1]]; ok {
+			return errors.New("could not synchronise network time: " + msg)
+		}
+		return errors.New("could not synchronise network time: " + m)
+	}
+	return nil
+}
+
+// GetClock reads the module clock (AT+CCLK), including its time zone.
+func (g *DefaultGsmModule) GetClock() (time.Time, error) {
+	err := g.sendCommand(string(ClockCommand))
+	if err != nil {
+		return time.Time{}, errors.New("could not read clock:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+CCLK: .*|%s)$`,
+		string(ErrorResponse))), 5*time.Second)
+	if err != nil {
+		return time.Time{}, errors.New("could not read clock:" + err.Error())
+	}
+	t, err := parseClock(m)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = g.waitForLine(okRegexp, 5*time.Second)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, nil
+}
+
+func parseClock(m string) (time.Time, error) {
+	s := clockRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return time.Time{}, errors.New("could not read clock: " + m)
+	}
+	var quarters int
+	_, err := fmt.Sscanf(s[2], "%d", &quarters)
+	if err != nil {
+		return time.Time{}, err
+	}
+	zone := time.FixedZone("", quarters*int(quarterHour/time.Second))
+	return time.ParseInLocation(clockLayout, s[1], zone)
+}
+
+// SetClock sets the module clock (AT+CCLK) to the given time. Time zones that are not a whole number of quarter
+// hours from UTC are converted to UTC.
+func (g *DefaultGsmModule) SetClock(t time.Time) error {
+	_, offset := t.Zone()
+	if offset%int(quarterHour/time.Second) != 0 {
+		t = t.UTC()
+		offset = 0
+	}
+	value := fmt.Sprintf("%s%+03d", t.Format(clockLayout), offset/int(quarterHour/time.Second))
+	err := g.executeATCommand(fmt.Sprintf(string(SetClockCommand), value))
+	if err != nil {
+		return errors.New("could not set clock:" + err.Error())
+	}
+	return nil
+}
+
+// ClockOffset reports how far the module clock is ahead of the system clock.
+func (g *DefaultGsmModule) ClockOffset() (time.Duration, error) {
+	t, err := g.GetClock()
+	if err != nil {
+		return 0, err
+	}
+	// the module clock has a resolution of one second
+	return t.Sub(time.Now().Truncate(time.Second)), nil
+}
+
+// SetNetworkTimeUpdate enables or disables updating the module clock and time zone from the network, with
+// AT+CLTS on SIM800 modules and AT+CTZU on SIM7000 and SIM7600 modules. SIM800 modules only apply the setting
+// after a restart.
+func (g *DefaultGsmModule) SetNetworkTimeUpdate(enabled bool) error {
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	var err error
+	switch g.model() {
+	case SIM7000, SIM7600:
+		err = g.executeATCommand(fmt.Sprintf(string(TimeZoneUpdateCommand), mode))
+	default:
+		err = g.executeATCommand(fmt.Sprintf(string(LocalTimestampCommand), mode))
+		if err == nil {
+			// save the setting, since it only takes effect after a restart
+			err = g.executeATCommand("AT&W")
+		}
+	}
+	if err != nil {
+		return errors.New("could not set network time update:" + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const jsonrpcImport = "github.com/bouwerp/gsmtcp/jsonrpc"
+
+var versionRegexp = regexp.MustCompile(`^v[0-9]+$`)
+
+// method is a method of the interface, as it is generated.
+type method struct {
+	Name string
+	// Request and Reply are the types of the request and reply, empty if the method has none.
+	Request string
+	Reply   string
+	// ReplyElem is the type pointed to by a pointer reply, empty if the reply is not a pointer.
+	ReplyElem string
+}
+
+type client struct {
+	Package   string
+	Interface string
+	Service   string
+	// JSONRPC is the name by which the client refers to the jsonrpc package, which may be aliased in the file
+	JSONRPC string
+	Imports []string
+	Methods []method
+}
+
+var clientTemplate = template.Must(template.New("client").Parse(`// Code generated by gsmrpcgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+// {{.Interface}}Client calls the methods of the {{.Service}} service over JSON-RPC.
+type {{.Interface}}Client struct {
+	Client *{{.JSONRPC}}.Client
+}
+
+// New{{.Interface}}Client creates a client that calls the {{.Service}} service with the JSON-RPC client.
+func New{{.Interface}}Client(c *{{.JSONRPC}}.Client) *{{.Interface}}Client {
+	return &{{.Interface}}Client{Client: c}
+}
+
+var _ {{.Interface}} = (*{{.Interface}}Client)(nil)
+{{range .Methods}}
+// {{.Name}} calls {{$.Service}}.{{.Name}}.
+func (c *{{$.Interface}}Client) {{.Name}}(ctx context.Context{{if .Request}}, req {{.Request}}{{end}}) (
+	{{- if .Reply}}{{.Reply}}, {{end}}error) {
+{{- $params := "nil"}}{{if .Request}}{{$params = "[]interface{}{req}"}}{{end}}
+{{- if .ReplyElem}}
+	reply := new({{.ReplyElem}})
+	err := c.Client.Call(ctx, "{{$.Service}}.{{.Name}}", {{$params}}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+{{- else if .Reply}}
+	var reply {{.Reply}}
+	err := c.Client.Call(ctx, "{{$.Service}}.{{.Name}}", {{$params}}, &reply)
+	return reply, err
+{{- else}}
+	return c.Client.Call(ctx, "{{$.Service}}.{{.Name}}", {{$params}}, nil)
+{{- end}}
+}
+{{end}}`))
+
+// generate generates the client of the interface declared in the package in dir.
+func generate(dir, typeName, service string) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, errors.New("could not parse package:" + err.Error())
+	}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			iface := findInterface(file, typeName)
+			if iface == nil {
+				continue
+			}
+			c, err := newClient(fset, file, iface, typeName, service)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			err = clientTemplate.Execute(&buf, c)
+			if err != nil {
+				return nil, err
+			}
+			src, err := format.Source(buf.Bytes())
+			if err != nil {
+				return nil, errors.New("could not format client:" + err.Error())
+			}
+			return src, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found in %s", typeName, dir)
+}
+
+func findInterface(file *ast.File, typeName string) *ast.InterfaceType {
+	var iface *ast.InterfaceType
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != typeName {
+			return iface == nil
+		}
+		iface, _ = spec.Type.(*ast.InterfaceType)
+		return false
+	})
+	return iface
+}
+
+func newClient(fset *token.FileSet, file *ast.File, iface *ast.InterfaceType, typeName, service string) (*client,
+	error) {
+	imports := fileImports(file)
+	c := &client{Package: file.Name.Name, Interface: typeName, Service: service, JSONRPC: "jsonrpc"}
+	// reuse the file's import of the jsonrpc package, so that an alias is not imported a second time
+	jsonrpcPath := strconv.Quote(jsonrpcImport)
+	jsonrpcSpec := jsonrpcPath
+	for name, spec := range imports {
+		if name != "_" && name != "." && strings.HasSuffix(spec, jsonrpcPath) {
+			c.JSONRPC, jsonrpcSpec = name, spec
+		}
+	}
+	used := map[string]bool{
+		strconv.Quote("context"): true,
+		jsonrpcSpec:              true,
+	}
+	for _, field := range iface.Methods.List {
+		if len(field.Names) == 0 {
+			return nil, fmt.Errorf("embedded interfaces are not supported: %s", exprString(fset, field.Type))
+		}
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok {
+			continue
+		}
+		m, err := newMethod(fset, field.Names[0].Name, ft)
+		if err != nil {
+			return nil, err
+		}
+		for _, expr := range fieldTypes(ft.Params) {
+			markImports(expr, imports, used)
+		}
+		for _, expr := range fieldTypes(ft.Results) {
+			markImports(expr, imports, used)
+		}
+		c.Methods = append(c.Methods, m)
+	}
+	if len(c.Methods) == 0 {
+		return nil, fmt.Errorf("interface %s has no methods", typeName)
+	}
+	for spec := range used {
+		c.Imports = append(c.Imports, spec)
+	}
+	sort.Strings(c.Imports)
+	return c, nil
+}
+
+// newMethod checks the signature of a method, which must be
+//
+//	Name(ctx context.Context[, req Request]) ([Reply, ]error)
+func newMethod(fset *token.FileSet, name string, ft *ast.FuncType) (method, error) {
+	m := method{Name: name}
+	params := fieldTypes(ft.Params)
+	results := fieldTypes(ft.Results)
+	if len(params) < 1 || len(params) > 2 || exprString(fset, params[0]) != "context.Context" {
+		return m, fmt.Errorf("method %s must take a context.Context and at most one request", name)
+	}
+	if len(results) < 1 || len(results) > 2 || exprString(fset, results[len(results)-1]) != "error" {
+		return m, fmt.Errorf("method %s must return an error, optionally preceded by a reply", name)
+	}
+	if len(params) == 2 {
+		m.Request = exprString(fset, params[1])
+	}
+	if len(results) == 2 {
+		m.Reply = exprString(fset, results[0])
+		if star, ok := results[0].(*ast.StarExpr); ok {
+			m.ReplyElem = exprString(fset, star.X)
+		}
+	}
+	return m, nil
+}
+
+// fieldTypes returns the type of each parameter of a list, repeating the type of grouped parameters.
+func fieldTypes(fields *ast.FieldList) []ast.Expr {
+	if fields == nil {
+		return nil
+	}
+	var types []ast.Expr
+	for _, field := range fields.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			types = append(types, field.Type)
+		}
+	}
+	return types
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, fset, expr)
+	return buf.String()
+}
+
+// fileImports maps the names by which a file refers to its imports to their import specs.
+func fileImports(file *ast.File) map[string]string {
+	imports := make(map[string]string)
+	for _, spec := range file.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if spec.Name != nil {
+			imports[spec.Name.Name] = spec.Name.Name + " " + spec.Path.Value
+			continue
+		}
+		// the package name is assumed to be the last element of the path, skipping a major version suffix
+		name := path.Base(p)
+		if versionRegexp.MatchString(name) && path.Dir(p) != "." {
+			name = path.Base(path.Dir(p))
+		}
+		name = strings.TrimPrefix(name, "go-")
+		imports[name] = spec.Path.Value
+	}
+	return imports
+}
+
+// markImports marks the imports referred to by a type expression as used.
+func markImports(expr ast.Expr, imports map[string]string, used map[string]bool) {
+	ast.Inspect(expr, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok {
+			if spec, ok := imports[id.Name]; ok {
+				used[spec] = true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestGenerate(t *testing.T) {
+	src, err := generate(filepath.Join("testdata", "greeter"), "Greeter", "Greeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "greeter_client.golden")
+	if *update {
+		err = ioutil.WriteFile(golden, src, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, expected) {
+		t.Errorf("generated client differs from %s:\n%s", golden, src)
+	}
+}
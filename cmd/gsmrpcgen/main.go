@@ -0,0 +1,64 @@
+// Command gsmrpcgen generates a typed JSON-RPC client for a Go interface, on top of the gsmtcp jsonrpc package, so that
+// methods are not called by name. For an interface
+//
+//	type Greeter interface {
+//		SayHello(ctx context.Context, req *HelloRequest) (*HelloReply, error)
+//	}
+//
+// it generates a GreeterClient whose SayHello calls "Greeter.SayHello", sending the request as the single by-position
+// param as DoRequest does. Methods take a context, optionally a request, and return an error, optionally preceded by
+// a reply.
+//
+// Usage:
+//
+//	gsmrpcgen -type Greeter [-service Greeter] [-o greeter_client.go] [dir]
+//
+// It is typically run with go:generate from the package that declares the interface:
+//
+//	//go:generate gsmrpcgen -type Greeter
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeName := flag.String("type", "", "name of the interface to generate a client for")
+	service := flag.String("service", "", "service name prefixed to method names; defaults to the interface name")
+	output := flag.String("o", "", "output file; defaults to <type>_client.go in the package directory")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: gsmrpcgen -type Interface [-service Name] [-o file] [dir]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *typeName == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	if *service == "" {
+		*service = *typeName
+	}
+	if *output == "" {
+		*output = filepath.Join(dir, strings.ToLower(*typeName)+"_client.go")
+	}
+
+	src, err := generate(dir, *typeName, *service)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "gsmrpcgen: "+err.Error())
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(*output, src, 0644)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "gsmrpcgen: could not write client:"+err.Error())
+		os.Exit(1)
+	}
+}
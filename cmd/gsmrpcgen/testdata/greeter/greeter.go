@@ -0,0 +1,18 @@
+package greeter
+
+import (
+	"context"
+	"time"
+
+	pb "example.com/greeter/proto/v2"
+	rpc "github.com/bouwerp/gsmtcp/jsonrpc"
+)
+
+type Greeter interface {
+	// SayHello has a pointer reply.
+	SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloReply, error)
+	// Uptime has a value reply and no request.
+	Uptime(ctx context.Context) (time.Duration, error)
+	// Report has no reply.
+	Report(ctx context.Context, req []rpc.Error) error
+}
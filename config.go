@@ -37,6 +37,20 @@ func getConfigValue(configType ConfigType, configs ...Config) interface{} {
 			return Verbose(false).Default()
 		case APNConfig:
 			return APN("").Default()
+		case ManualReceiveConfig:
+			return ManualReceive(false).Default()
+		case QuickSendConfig:
+			return QuickSend(false).Default()
+		case UsageFileConfig:
+			return UsageFile("").Default()
+		case BillingCycleDayConfig:
+			return BillingCycleDay(0).Default()
+		case ModelConfig:
+			return Model("").Default()
+		case TransparentModeConfig:
+			return TransparentMode(false).Default()
+		case TCPKeepAliveConfig:
+			return TCPKeepAlive(0).Default()
 		default:
 			return nil
 		}
@@ -138,3 +152,133 @@ func (c Verbose) Value() interface{} {
 func (Verbose) Default() interface{} {
 	return Verbose(false)
 }
+
+// ManualReceive enables buffered receive mode (AT+CIPRXGET=1), in which incoming data is held by the module
+// and retrieved explicitly, keeping it separate from command responses and unsolicited result codes.
+type ManualReceive bool
+
+const ManualReceiveConfig ConfigType = "ManualReceiveConfig"
+
+func (ManualReceive) Type() ConfigType {
+	return ManualReceiveConfig
+}
+
+func (c ManualReceive) Value() interface{} {
+	return c
+}
+
+func (ManualReceive) Default() interface{} {
+	return ManualReceive(false)
+}
+
+// TransparentMode enables transparent mode (AT+CIPMODE=1), in which connection reads and writes go straight to
+// the serial line instead of through AT+CIPSEND.
+type TransparentMode bool
+
+const TransparentModeConfig ConfigType = "TransparentModeConfig"
+
+func (TransparentMode) Type() ConfigType {
+	return TransparentModeConfig
+}
+
+func (c TransparentMode) Value() interface{} {
+	return c
+}
+
+func (TransparentMode) Default() interface{} {
+	return TransparentMode(false)
+}
+
+// QuickSend enables quick send mode (AT+CIPQSEND=1), in which sending data only waits for the module to accept it
+// rather than for it to be sent to the network.
+type QuickSend bool
+
+const QuickSendConfig ConfigType = "QuickSendConfig"
+
+func (QuickSend) Type() ConfigType {
+	return QuickSendConfig
+}
+
+func (c QuickSend) Value() interface{} {
+	return c
+}
+
+func (QuickSend) Default() interface{} {
+	return QuickSend(false)
+}
+
+// TCPKeepAlive is the idle time after which the module sends TCP keepalive probes (AT+CIPTKA), which keeps carrier
+// NATs from dropping idle connections. It must be between 30 seconds and 2 hours; zero disables keepalive. Modules
+// without AT+CIPTKA still connect, and rely on the heartbeat set with Conn.SetHeartbeat instead, which starts as
+// soon as it is set.
+type TCPKeepAlive time.Duration
+
+const TCPKeepAliveConfig ConfigType = "TCPKeepAliveConfig"
+
+func (TCPKeepAlive) Type() ConfigType {
+	return TCPKeepAliveConfig
+}
+
+func (c TCPKeepAlive) Value() interface{} {
+	return c
+}
+
+func (TCPKeepAlive) Default() interface{} {
+	return TCPKeepAlive(0)
+}
+
+// Model identifies the module series, which determines the AT command set used for some functions.
+type Model string
+
+const SIM800 Model = "SIM800"
+const SIM7000 Model = "SIM7000"
+const SIM7600 Model = "SIM7600"
+
+const ModelConfig ConfigType = "ModelConfig"
+
+func (Model) Type() ConfigType {
+	return ModelConfig
+}
+
+func (c Model) Value() interface{} {
+	return c
+}
+
+func (Model) Default() interface{} {
+	return SIM800
+}
+
+// UsageFile is the file that the module's data usage is persisted to across restarts. Usage is not persisted if it
+// is empty.
+type UsageFile string
+
+const UsageFileConfig ConfigType = "UsageFileConfig"
+
+func (UsageFile) Type() ConfigType {
+	return UsageFileConfig
+}
+
+func (c UsageFile) Value() interface{} {
+	return c
+}
+
+func (UsageFile) Default() interface{} {
+	return UsageFile("")
+}
+
+// BillingCycleDay is the day of the month (1-28) on which the data usage is reset.
+type BillingCycleDay int
+
+const BillingCycleDayConfig ConfigType = "BillingCycleDayConfig"
+
+func (BillingCycleDay) Type() ConfigType {
+	return BillingCycleDayConfig
+}
+
+func (c BillingCycleDay) Value() interface{} {
+	return c
+}
+
+func (BillingCycleDay) Default() interface{} {
+	return BillingCycleDay(1)
+}
@@ -6,13 +6,80 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 type Conn struct {
 	g             *DefaultGsmModule
+	network       string
 	remoteAddress string
+	secure        *secureSession
+	usage         *connUsage
+	deadline      *connDeadline
+	received      *receiveBuffer
+	keepAlive     *keepAliveState
+	state         *connState
+	localIP       net.IP
+}
+
+// connState records whether a connection has been closed, so that pending and later reads and writes fail.
+type connState struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *connState) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// close marks the connection closed, reporting false if it already was.
+func (s *connState) close() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	return true
+}
+
+// receiveBuffer holds the data retrieved from the module that has not been read yet. The module is always asked for
+// a full chunk, so that small reads do not each cost an AT command round trip.
+type receiveBuffer struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// connDeadline holds the read and write deadlines of a connection. A zero time means no deadline.
+type connDeadline struct {
+	mu    sync.Mutex
+	read  time.Time
+	write time.Time
+}
+
+func (d *connDeadline) get() (read time.Time, write time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.read, d.write
+}
+
+// waitUntil returns how long to wait for the module, at most max, without passing the deadline. It returns
+// TimedOutErr once the deadline has passed.
+func waitUntil(deadline time.Time, max time.Duration) (time.Duration, error) {
+	if deadline.IsZero() {
+		return max, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, TimedOutErr{}
+	}
+	if remaining < max {
+		return remaining, nil
+	}
+	return max, nil
 }
 
 type Reader struct {
@@ -28,63 +95,276 @@ func NewReader(c net.Conn) io.Reader {
 }
 
 func NewConnection(g *DefaultGsmModule, address string) (net.Conn, error) {
-	// first make sure it's a new connection
+	return openConnection(g, "tcp", address, false)
+}
+
+// NewUDPConnection sets up a UDP connection on the module. Each Write sends one datagram.
+func NewUDPConnection(g *DefaultGsmModule, address string) (net.Conn, error) {
+	return openConnection(g, "udp", address, false)
+}
+
+// openConnection opens a connection on the module's TCP/IP stack, optionally secured with the module's SSL
+// function (AT+CIPSSL). As the stack has a single connection, AlreadyConnectedErr is returned while a connection
+// opened before has not been closed.
+func openConnection(g *DefaultGsmModule, network string, address string, ssl bool) (net.Conn, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.connOpen {
+		return nil, AlreadyConnectedErr{}
+	}
+	// clear a connection left behind by an earlier process
 	_ = g.CloseTcpConnection()
 
-	log.Debug().Msg("connecting to server")
-	err := g.OpenTcpConnection(address)
+	transparent := bool(getConfigValue(TransparentModeConfig, g.configs...).(TransparentMode))
+	if transparent && bool(getConfigValue(ManualReceiveConfig, g.configs...).(ManualReceive)) {
+		return nil, errors.New("manual receive is not supported in transparent mode")
+	}
+	if transparent != g.transparent {
+		err := g.SetTransparentMode(transparent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	quickSend := bool(getConfigValue(QuickSendConfig, g.configs...).(QuickSend))
+	if !transparent && quickSend != g.quickSend {
+		err := g.SetQuickSend(quickSend)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bool(getConfigValue(ManualReceiveConfig, g.configs...).(ManualReceive)) != g.manualReceive {
+		err := g.SetManualReceive(!g.manualReceive)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := g.configureReceiveHeader()
 	if err != nil {
 		return nil, err
 	}
+	if ssl != g.ssl {
+		err := g.SetSSL(ssl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keepAlive := time.Duration(getConfigValue(TCPKeepAliveConfig, g.configs...).(TCPKeepAlive))
+	if keepAlive != g.keepAlive && !g.noTCPKeepAlive {
+		err := g.SetTCPKeepAlive(keepAlive)
+		if err != nil && g.noTCPKeepAlive {
+			// reported once, as the command is not tried again
+			log.Warn().Msg("the module does not support TCP keepalive (AT+CIPTKA), so connections rely on the " +
+				"heartbeat set with Conn.SetHeartbeat")
+		} else if err != nil {
+			log.Error().Err(err).Msg("could not set TCP keepalive")
+		}
+	}
+
+	// the address changes whenever the bearer is re-established, and cannot be queried once in data mode
+	_, err = g.GetLocalIPAddress()
+	if err != nil {
+		g.localIP = nil
+		log.Debug().Err(err).Msg("could not determine local IP address")
+	}
 
-	log.Debug().Msg("check if we're connected")
-	connected, err := g.IsConnected()
+	log.Debug().Msg("connecting to server")
+	if network == "udp" {
+		err = g.OpenUdpConnection(address)
+	} else {
+		err = g.OpenTcpConnection(address)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if !connected {
-		return nil, errors.New("not connected")
+
+	// in data mode the CONNECT response already confirmed the connection
+	if !g.dataMode {
+		log.Debug().Msg("check if we're connected")
+		connected, err := g.IsConnected()
+		if err != nil {
+			return nil, err
+		}
+		if !connected {
+			return nil, errors.New("not connected")
+		}
 	}
 
 	log.Debug().Msg("successfully connected")
+	g.connOpen = true
+	c := newConn(g, network, address)
+	c.keepAlive.enabled = keepAlive != 0
+	c.keepAlive.period = keepAlive
+	c.keepAlive.fallback = g.noTCPKeepAlive
+	c.accountConnection()
+	return c, nil
+}
+
+// newConn creates the Conn for a connection established on the module's TCP/IP stack.
+func newConn(g *DefaultGsmModule, network string, address string) *Conn {
 	return &Conn{
 		g:             g,
+		network:       network,
 		remoteAddress: address,
-	}, nil
+		usage:         &connUsage{},
+		deadline:      &connDeadline{},
+		received:      &receiveBuffer{},
+		keepAlive:     &keepAliveState{enabled: g.keepAlive != 0, period: g.keepAlive, lastWrite: time.Now()},
+		state:         &connState{},
+		localIP:       g.localIP,
+	}
 }
 
 func (c Conn) Read(b []byte) (n int, err error) {
-	var data []byte
+	n, err = c.read(b)
+	c.accountPayload(n, 0)
+	return n, err
+}
+
+// read returns the data already retrieved from the module, or else waits for the next chunk. It returns as soon as
+// any data is available rather than waiting for b to be filled.
+func (c Conn) read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.received.mu.Lock()
+	defer c.received.mu.Unlock()
+	if len(c.received.data) == 0 {
+		data, err := c.receive()
+		if err != nil {
+			return 0, err
+		}
+		c.received.data = data
+	}
+	n = copy(b, c.received.data)
+	c.received.data = c.received.data[n:]
+	return n, nil
+}
+
+// receivePollInterval is the longest a read holds the module while waiting for data, so that writes on the same
+// connection are not held up.
+const receivePollInterval = 50 * time.Millisecond
+
+// receive retrieves the next chunk of data from the module, blocking until at least one byte has arrived, the read
+// deadline has passed or the connection has been closed.
+func (c Conn) receive() ([]byte, error) {
+	buf := make([]byte, maxReceiveLength)
 	for {
-		if len(data) == len(b) {
-			copy(b, data)
-			return len(data), nil
+		if c.state.isClosed() {
+			return nil, ClosedErr{}
 		}
-		d, err := c.g.ReadData()
+		deadline, _ := c.deadline.get()
+		wait, err := waitUntil(deadline, receivePollInterval)
 		if err != nil {
-			if err == io.EOF || err.Error() == "EOF" {
-				copy(b, data)
-				return len(data), nil
-			}
-			return 0, err
+			return nil, err
+		}
+		c.g.mu.Lock()
+		n, err := c.poll(buf, wait)
+		c.g.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return buf[:n], nil
+		}
+	}
+}
+
+// poll retrieves the data received by the module, waiting for it no longer than the given time. It returns no data
+// and no error if nothing has arrived. The caller must hold the module's lock.
+func (c Conn) poll(b []byte, wait time.Duration) (int, error) {
+	switch {
+	case c.secure != nil:
+		return c.secure.poll(b, wait)
+	case c.g.transparent:
+		n, err := c.g.readTransparentData(b, time.Now().Add(wait))
+		if _, ok := err.(TimedOutErr); ok {
+			return 0, nil
 		}
-		data = append(data, d)
+		return n, err
+	case c.g.manualReceive:
+		return c.g.pollBuffered(b, wait)
+	default:
+		return c.g.pollRaw(b, wait)
 	}
 }
 
 func (c Conn) Write(b []byte) (n int, err error) {
-	n, err = c.g.SendRawTcpData(b)
+	c.keepAlive.writing.Lock()
+	defer c.keepAlive.writing.Unlock()
+	return c.send(b)
+}
+
+// send writes and accounts the data. The caller must hold keepAlive.writing.
+func (c Conn) send(b []byte) (n int, err error) {
+	n, err = c.write(b)
+	c.accountPayload(0, n)
+	c.keepAlive.touch()
+	return n, err
+}
+
+// write sends the data, bounding each wait for the module by the write deadline.
+func (c Conn) write(b []byte) (n int, err error) {
+	if c.state.isClosed() {
+		return 0, ClosedErr{}
+	}
+	_, deadline := c.deadline.get()
+	_, err = waitUntil(deadline, 0)
+	if err != nil {
+		return 0, err
+	}
+	c.g.mu.Lock()
+	switch {
+	case c.secure != nil:
+		n, err = c.secure.write(b)
+	case c.g.transparent:
+		n, err = c.g.writeTransparentData(b)
+	default:
+		n, err = c.g.sendRawTcpData(b, deadline)
+	}
+	c.g.mu.Unlock()
 	if err != nil {
 		switch err.(type) {
 		case MaxBytesErr:
-			return c.Write(b[n:])
+			m, err := c.write(b[n:])
+			return n + m, err
 		}
-		return 0, err
+		if n < 0 {
+			return 0, err
+		}
+		return n, err
 	}
 	return n, nil
 }
 
+// Acknowledgement reports how much of the data written to the connection has been acknowledged by the peer, which
+// indicates where an interrupted transfer can be resumed.
+func (c Conn) Acknowledgement() (Acknowledgement, error) {
+	c.g.mu.Lock()
+	defer c.g.mu.Unlock()
+	return c.g.GetAcknowledgement()
+}
+
+// Close closes the connection. Pending reads and writes fail with ClosedErr once the module has finished the
+// exchange in progress.
 func (c Conn) Close() error {
+	if !c.state.close() {
+		return ClosedErr{}
+	}
+	c.keepAlive.mu.Lock()
+	c.keepAlive.stopHeartbeat()
+	c.keepAlive.mu.Unlock()
+	defer func() {
+		err := c.g.SaveUsage()
+		if err != nil {
+			log.Error().Err(err).Msg("could not save usage")
+		}
+	}()
+	c.g.mu.Lock()
+	defer c.g.mu.Unlock()
+	c.g.connOpen = false
+	if c.secure != nil {
+		return c.secure.close()
+	}
 	err := c.g.CloseTcpConnection()
 	if err != nil {
 		return err
@@ -92,72 +372,76 @@ func (c Conn) Close() error {
 	return nil
 }
 
+// LocalAddr returns the module's IP address, as cached when the connection was opened. The module does not report
+// the local port, so it is zero.
 func (c Conn) LocalAddr() net.Addr {
-	ip, err := c.g.GetLocalIPAddress()
-	if err != nil {
-		return nil
-	}
-	s := strings.Split(ip, ".")
-	ip1, err := strconv.Atoi(s[0])
-	if err != nil {
-		return nil
+	if c.network == "udp" {
+		return &net.UDPAddr{IP: c.localIP}
 	}
-	ip2, err := strconv.Atoi(s[1])
-	if err != nil {
-		return nil
-	}
-	ip3, err := strconv.Atoi(s[2])
-	if err != nil {
-		return nil
-	}
-	ip4, err := strconv.Atoi(s[3])
-	if err != nil {
-		return nil
-	}
-	return &net.IPAddr{IP: []byte{byte(ip1), byte(ip2), byte(ip3), byte(ip4)}}
+	return &net.TCPAddr{IP: c.localIP}
 }
 
+// RemoteAddr returns the address the connection was opened to. Connections opened by host name return an address
+// holding the unresolved name, as the module resolves it internally.
 func (c Conn) RemoteAddr() net.Addr {
-	s := strings.Split(strings.Split(c.remoteAddress, ":")[0], ".")
-	ip1, err := strconv.Atoi(s[0])
-	if err != nil {
-		return nil
-	}
-	ip2, err := strconv.Atoi(s[1])
+	return parseAddr(c.network, c.remoteAddress)
+}
+
+// hostAddr is the address of a connection opened by host name.
+type hostAddr struct {
+	network string
+	address string
+}
+
+func (a hostAddr) Network() string {
+	return a.network
+}
+
+func (a hostAddr) String() string {
+	return a.address
+}
+
+// parseAddr converts a host:port address to a *net.TCPAddr or *net.UDPAddr, falling back to a hostAddr if the host
+// is not an IP address.
+func parseAddr(network string, address string) net.Addr {
+	host, portStr, err := net.SplitHostPort(address)
 	if err != nil {
-		return nil
+		return hostAddr{network: network, address: address}
 	}
-	ip3, err := strconv.Atoi(s[2])
-	if err != nil {
-		return nil
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return hostAddr{network: network, address: address}
 	}
-	ip4, err := strconv.Atoi(s[3])
-	if err != nil {
-		return nil
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: port}
 	}
-	return &net.IPAddr{IP: []byte{byte(ip1), byte(ip2), byte(ip3), byte(ip4)}}
+	return &net.TCPAddr{IP: ip, Port: port}
 }
 
+// SetDeadline sets the read and write deadlines. A zero time means Read and Write will not time out.
 func (c Conn) SetDeadline(t time.Time) error {
-	if t.Before(time.Now()) {
-		return errors.New("dealine has already passed")
-	}
-	c.g.TotalDeadline = t
+	c.deadline.mu.Lock()
+	defer c.deadline.mu.Unlock()
+	c.deadline.read = t
+	c.deadline.write = t
 	return nil
 }
 
+// SetReadDeadline sets the deadline for Read calls, after which they fail with a timeout error. As the module is
+// polled, a blocked Read notices a change of the deadline within 50 milliseconds.
 func (c Conn) SetReadDeadline(t time.Time) error {
-	if t.Before(time.Now()) {
-		return errors.New("dealine has already passed")
-	}
-	c.g.ReadDeadline = t
+	c.deadline.mu.Lock()
+	defer c.deadline.mu.Unlock()
+	c.deadline.read = t
 	return nil
 }
 
+// SetWriteDeadline sets the deadline for Write calls. A packet that has already been handed to the module is not
+// recalled, but the wait for its confirmation ends at the deadline and the packet is counted as written.
 func (c Conn) SetWriteDeadline(t time.Time) error {
-	if t.Before(time.Now()) {
-		return errors.New("dealine has already passed")
-	}
-	c.g.WriteDeadline = t
+	c.deadline.mu.Lock()
+	defer c.deadline.mu.Unlock()
+	c.deadline.write = t
 	return nil
 }
@@ -0,0 +1,171 @@
+package gsmtcp
+
+import (
+	"golang.org/x/net/nettest"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makePipe connects a Conn on a fake modem to a local listener.
+func makePipe(configs ...Config) nettest.MakePipe {
+	return func() (net.Conn, net.Conn, func(), error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}()
+		modem := newFakeModem()
+		g := &DefaultGsmModule{sp: modem, configs: configs, usage: newUsageMeter("", 1)}
+		c1, err := NewConnection(g, ln.Addr().String())
+		if err != nil {
+			_ = ln.Close()
+			_ = modem.Close()
+			return nil, nil, nil, err
+		}
+		c2 := <-accepted
+		stop := func() {
+			_ = c1.Close()
+			_ = c2.Close()
+			_ = ln.Close()
+			_ = modem.Close()
+		}
+		return c1, c2, stop, nil
+	}
+}
+
+func TestConn(t *testing.T) {
+	nettest.TestConn(t, makePipe())
+}
+
+func TestConnManualReceive(t *testing.T) {
+	nettest.TestConn(t, makePipe(ManualReceive(true)))
+}
+
+func TestConnSingleConnection(t *testing.T) {
+	c1, c2, stop, err := makePipe()()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	g := c1.(*Conn).g
+	_, err = NewConnection(g, c2.LocalAddr().String())
+	if _, ok := err.(AlreadyConnectedErr); !ok {
+		t.Fatalf("second connection: got %v, want AlreadyConnectedErr", err)
+	}
+	err = c1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConnection(g, c2.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("connection after close: %v", err)
+	}
+	_ = c.Close()
+}
+
+func TestConnAddressWithoutPort(t *testing.T) {
+	modem := newFakeModem()
+	defer modem.Close()
+	g := &DefaultGsmModule{sp: modem, usage: newUsageMeter("", 1)}
+	_, err := NewConnection(g, "example.com")
+	if err == nil {
+		t.Fatal("connection without a port: got no error")
+	}
+}
+
+func TestReconnectingConnRedialsAfterPeerClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	modem := newFakeModem()
+	defer modem.Close()
+	g := &DefaultGsmModule{sp: modem, usage: newUsageMeter("", 1)}
+	c, err := NewReconnectingConn(g, ln.Addr().String(), ReconnectOptions{MinDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	first, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = first.Close()
+	go func() {
+		second, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer second.Close()
+		_, _ = second.Write([]byte("after"))
+		_, _ = io.Copy(ioutil.Discard, second)
+	}()
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "after" {
+		t.Fatalf("got %q, want %q", b, "after")
+	}
+}
+
+func TestConnWithoutTCPKeepAlive(t *testing.T) {
+	c1, _, stop, err := makePipe(TCPKeepAlive(time.Minute))()
+	if err != nil {
+		t.Fatalf("connection without AT+CIPTKA: %v", err)
+	}
+	defer stop()
+	c := c1.(*Conn)
+	c.SetHeartbeat(func(w io.Writer) error {
+		_, err := w.Write([]byte{0})
+		return err
+	})
+	c.keepAlive.mu.Lock()
+	started := c.keepAlive.stop != nil
+	c.keepAlive.mu.Unlock()
+	if !started {
+		t.Error("heartbeat not started for the configured keepalive")
+	}
+	err = c.SetKeepAlive(true)
+	if err != nil {
+		t.Fatalf("keepalive with heartbeat: %v", err)
+	}
+
+	// the module is not asked again on the next connection
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewConnection(c.g, c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	modem := c.g.sp.(*fakeModem)
+	modem.mu.Lock()
+	defer modem.mu.Unlock()
+	tries := 0
+	for _, cmd := range modem.commands {
+		if strings.HasPrefix(cmd, "AT+CIPTKA=") {
+			tries++
+		}
+	}
+	if tries != 1 {
+		t.Errorf("AT+CIPTKA sent %d times, want once", tries)
+	}
+}
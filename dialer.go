@@ -0,0 +1,100 @@
+package gsmtcp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer opens connections through a GSM module. Its Dial and DialContext methods have the signatures expected by
+// http.Transport, grpc.WithContextDialer and other libraries that accept a dial function. The supported networks are
+// "tcp", "tcp4" and "udp". Failures are returned as *net.OpError.
+//
+// The module's TCP/IP stack has a single connection, so a dial fails with AlreadyConnectedErr while a connection
+// opened on the module, through the Dialer or otherwise, has not been closed. Clients that pool connections, such as
+// http.Transport, must be limited to one connection per module and close idle connections before dialling another
+// host.
+type Dialer struct {
+	Module *DefaultGsmModule
+	// Timeout is the maximum time a dial may take. Zero means no timeout other than the context's.
+	Timeout time.Duration
+	// TLS selects the module's own SSL function (AT+CIPSSL) for TCP connections.
+	TLS bool
+
+	// the module handles one connection attempt at a time
+	mu sync.Mutex
+}
+
+// NewDialer creates a dialer for the given module.
+func NewDialer(g *DefaultGsmModule) *Dialer {
+	return &Dialer{Module: g}
+}
+
+// Dial connects to the address on the named network.
+func (d *Dialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network. If the context expires before the connection is
+// complete, an error is returned; as an AT command cannot be interrupted, the module finishes the attempt in the
+// background and the connection is closed again.
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network, Addr: parseAddr(network, address), Err: err}
+	}
+	switch network {
+	case "tcp", "tcp4", "udp":
+	default:
+		return nil, opError(net.UnknownNetworkError(network))
+	}
+	_, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, opError(err)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		return nil, opError(ctx.Err())
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if ctx.Err() != nil {
+			results <- result{err: ctx.Err()}
+			return
+		}
+		var conn net.Conn
+		var err error
+		if network == "udp" {
+			conn, err = NewUDPConnection(d.Module, address)
+		} else {
+			conn, err = openConnection(d.Module, "tcp", address, d.TLS)
+		}
+		results <- result{conn: conn, err: err}
+	}()
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return nil, opError(res.err)
+		}
+		return res.conn, nil
+	case <-ctx.Done():
+		go func() {
+			res := <-results
+			if res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+		return nil, opError(ctx.Err())
+	}
+}
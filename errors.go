@@ -14,6 +14,16 @@ func (e TimedOutErr) Error() string {
 	return "timed out"
 }
 
+// Timeout reports that the error is a timeout, so that TimedOutErr satisfies net.Error.
+func (e TimedOutErr) Timeout() bool {
+	return true
+}
+
+// Temporary reports that the operation may succeed if it is retried.
+func (e TimedOutErr) Temporary() bool {
+	return true
+}
+
 type NotReadyErr struct {
 }
 
@@ -27,3 +37,34 @@ type MaxBytesErr struct {
 func (e MaxBytesErr) Error() string {
 	return "maximum packet size reached"
 }
+
+type DataModeErr struct {
+}
+
+func (e DataModeErr) Error() string {
+	return "module is in data mode"
+}
+
+type QueueFullErr struct {
+}
+
+func (e QueueFullErr) Error() string {
+	return "queue is full"
+}
+
+// NotConnectedErr is returned by a Queue's send function when it fails before a connection is established, such as
+// when dialling fails while the link is down. It is not counted as a delivery attempt.
+type NotConnectedErr struct {
+	Err error
+}
+
+func (e NotConnectedErr) Error() string {
+	return "not connected: " + e.Err.Error()
+}
+
+type ClosedErr struct {
+}
+
+func (e ClosedErr) Error() string {
+	return "use of closed connection"
+}
@@ -0,0 +1,497 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ftpChunkSize is the largest amount of data read from the module at once.
+const ftpChunkSize = 1024
+
+// ftpTimeout bounds the time the module may take to respond to an FTP operation.
+const ftpTimeout = 75 * time.Second
+
+// FTPErrorCode is a result code reported by the module's FTP service.
+type FTPErrorCode int
+
+const FTPNetError FTPErrorCode = 61
+const FTPDNSError FTPErrorCode = 62
+const FTPConnectError FTPErrorCode = 63
+const FTPTimeout FTPErrorCode = 64
+const FTPServerError FTPErrorCode = 65
+const FTPOperationNotAllowed FTPErrorCode = 66
+const FTPReplayError FTPErrorCode = 70
+const FTPUserError FTPErrorCode = 71
+const FTPPasswordError FTPErrorCode = 72
+const FTPTypeError FTPErrorCode = 73
+const FTPRestError FTPErrorCode = 74
+const FTPPassiveError FTPErrorCode = 75
+const FTPActiveError FTPErrorCode = 76
+const FTPOperateError FTPErrorCode = 77
+const FTPUploadError FTPErrorCode = 78
+const FTPDownloadError FTPErrorCode = 79
+const FTPManualQuit FTPErrorCode = 86
+
+var ftpErrorDescriptions = map[FTPErrorCode]string{
+	FTPNetError:            "net error",
+	FTPDNSError:            "DNS error",
+	FTPConnectError:        "connect error",
+	FTPTimeout:             "timeout",
+	FTPServerError:         "server error",
+	FTPOperationNotAllowed: "operation not allowed",
+	FTPReplayError:         "replay error",
+	FTPUserError:           "user error",
+	FTPPasswordError:       "password error",
+	FTPTypeError:           "type error",
+	FTPRestError:           "rest error",
+	FTPPassiveError:        "passive error",
+	FTPActiveError:         "active error",
+	FTPOperateError:        "operate error",
+	FTPUploadError:         "upload error",
+	FTPDownloadError:       "download error",
+	FTPManualQuit:          "manual quit",
+}
+
+// FTPError is returned when the module's FTP service reports a failure.
+type FTPError struct {
+	Op   string
+	Code FTPErrorCode
+}
+
+func (e FTPError) Error() string {
+	desc, ok := ftpErrorDescriptions[e.Code]
+	if !ok {
+		desc = "unknown error"
+	}
+	return fmt.Sprintf("ftp %s: %s (%d)", e.Op, desc, e.Code)
+}
+
+// FTPConfig holds the server and credentials used by an FTPClient.
+type FTPConfig struct {
+	Server   string
+	Port     int
+	User     string
+	Password string
+	// Active selects active mode instead of the default passive mode.
+	Active bool
+}
+
+// FTPClient transfers files with the module's built-in FTP service (AT+FTP). The module handles one operation at
+// a time: an operation waits until the reader or writer of the previous transfer has been closed.
+type FTPClient struct {
+	g      *DefaultGsmModule
+	config FTPConfig
+	mu     sync.Mutex
+}
+
+// NewFTPClient creates an FTP client that uses the FTP service of the module.
+func (g *DefaultGsmModule) NewFTPClient(config FTPConfig) *FTPClient {
+	if config.Port == 0 {
+		config.Port = 21
+	}
+	if config.User == "" {
+		config.User = "anonymous"
+	}
+	return &FTPClient{g: g, config: config}
+}
+
+// setup opens the bearer and configures the session parameters.
+func (c *FTPClient) setup() error {
+	err := c.g.OpenBearer()
+	if err != nil {
+		return err
+	}
+	mode := 1
+	if c.config.Active {
+		mode = 0
+	}
+	cmds := []string{
+		fmt.Sprintf("AT+FTPCID=%d", bearerProfile),
+		fmt.Sprintf(`AT+FTPSERV="%s"`, c.config.Server),
+		fmt.Sprintf("AT+FTPPORT=%d", c.config.Port),
+		fmt.Sprintf(`AT+FTPUN="%s"`, c.config.User),
+		fmt.Sprintf(`AT+FTPPW="%s"`, c.config.Password),
+		fmt.Sprintf("AT+FTPMODE=%d", mode),
+		`AT+FTPTYPE="I"`,
+	}
+	for _, cmd := range cmds {
+		err := c.g.executeATCommand(cmd)
+		if err != nil {
+			return errors.New("could not configure FTP session:" + err.Error())
+		}
+	}
+	return nil
+}
+
+// setGetPath sets the remote file used by download, size and delete operations.
+func (c *FTPClient) setGetPath(p string) error {
+	err := c.g.executeATCommand(fmt.Sprintf(`AT+FTPGETPATH="%s"`, ftpDir(p)))
+	if err == nil {
+		err = c.g.executeATCommand(fmt.Sprintf(`AT+FTPGETNAME="%s"`, path.Base(p)))
+	}
+	if err != nil {
+		return errors.New("could not set FTP path:" + err.Error())
+	}
+	return nil
+}
+
+// ftpDir returns the directory of a remote path, with the trailing slash expected by the module.
+func ftpDir(p string) string {
+	dir := path.Dir(p)
+	if dir == "/" {
+		return dir
+	}
+	return dir + "/"
+}
+
+// execute runs an FTP operation that reports its result as "+FTP<op>: 1,<code>[,<value>]", returning the code, which
+// is 0 or 1, and the value.
+func (c *FTPClient) execute(op string, cmd string) (int, string, error) {
+	err := c.g.sendCommand(cmd)
+	if err != nil {
+		return 0, "", errors.New("could not execute FTP " + op + ":" + err.Error())
+	}
+	return c.waitForResult(op)
+}
+
+// waitForResult waits for the "+FTP<op>: 1,<code>[,<value>]" result of an FTP operation, returning the code and the
+// value.
+func (c *FTPClient) waitForResult(op string) (int, string, error) {
+	exp := regexp.MustCompile(fmt.Sprintf(`^\+FTP%s: 1,([0-9]+)(,([0-9]+))?$`, op))
+	m, err := c.g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+FTP%s: 1,.*|%s)$`,
+		op,
+		string(ErrorResponse))), ftpTimeout)
+	if err != nil {
+		return 0, "", errors.New("could not execute FTP " + op + ":" + err.Error())
+	}
+	s := exp.FindStringSubmatch(m)
+	if s == nil {
+		return 0, "", errors.New("could not execute FTP " + op + ": " + m)
+	}
+	code, _ := strconv.Atoi(s[1])
+	if code != 0 && code != 1 {
+		return 0, "", FTPError{Op: op, Code: FTPErrorCode(code)}
+	}
+	return code, s[3], nil
+}
+
+// Size returns the size of a remote file (AT+FTPSIZE).
+func (c *FTPClient) Size(p string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.setup()
+	if err != nil {
+		return 0, err
+	}
+	err = c.setGetPath(p)
+	if err != nil {
+		return 0, err
+	}
+	_, size, err := c.execute("SIZE", "AT+FTPSIZE")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(size, 10, 64)
+}
+
+// Delete removes a remote file (AT+FTPDELE).
+func (c *FTPClient) Delete(p string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.setup()
+	if err != nil {
+		return err
+	}
+	err = c.setGetPath(p)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.execute("DELE", "AT+FTPDELE")
+	return err
+}
+
+// MakeDir creates a remote directory (AT+FTPMKD).
+func (c *FTPClient) MakeDir(p string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.setup()
+	if err != nil {
+		return err
+	}
+	err = c.g.executeATCommand(fmt.Sprintf(`AT+FTPGETPATH="%s"`, p))
+	if err != nil {
+		return errors.New("could not set FTP path:" + err.Error())
+	}
+	_, _, err = c.execute("MKD", "AT+FTPMKD")
+	return err
+}
+
+// Retrieve downloads a remote file, starting at the given offset (AT+FTPREST) so that interrupted downloads can be
+// resumed. The returned reader must be closed to release the module.
+func (c *FTPClient) Retrieve(p string, offset int64) (io.ReadCloser, error) {
+	c.mu.Lock()
+	r, err := c.retrieve(p, offset)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *FTPClient) retrieve(p string, offset int64) (io.ReadCloser, error) {
+	err := c.setup()
+	if err != nil {
+		return nil, err
+	}
+	err = c.setGetPath(p)
+	if err != nil {
+		return nil, err
+	}
+	err = c.g.executeATCommand(fmt.Sprintf("AT+FTPREST=%d", offset))
+	if err != nil {
+		return nil, errors.New("could not set FTP offset:" + err.Error())
+	}
+	code, _, err := c.execute("GET", "AT+FTPGET=1")
+	if err != nil {
+		return nil, err
+	}
+	// a zero code ends the transfer at once, as for an empty file
+	return &ftpReader{c: c, finished: code == 0, eof: code == 0}, nil
+}
+
+// Store uploads a remote file, replacing it, or appending to it if appendMode is set so that interrupted uploads
+// can be resumed. The returned writer must be closed to complete the upload and release the module.
+func (c *FTPClient) Store(p string, appendMode bool) (io.WriteCloser, error) {
+	c.mu.Lock()
+	w, err := c.store(p, appendMode)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	return w, nil
+}
+
+var ftpPutRegexp = regexp.MustCompile(`^\+FTPPUT: 1,([0-9]+)(,([0-9]+))?$`)
+
+func (c *FTPClient) store(p string, appendMode bool) (io.WriteCloser, error) {
+	err := c.setup()
+	if err != nil {
+		return nil, err
+	}
+	opt := "STOR"
+	if appendMode {
+		opt = "APPE"
+	}
+	cmds := []string{
+		fmt.Sprintf(`AT+FTPPUTPATH="%s"`, ftpDir(p)),
+		fmt.Sprintf(`AT+FTPPUTNAME="%s"`, path.Base(p)),
+		fmt.Sprintf(`AT+FTPPUTOPT="%s"`, opt),
+	}
+	for _, cmd := range cmds {
+		err := c.g.executeATCommand(cmd)
+		if err != nil {
+			return nil, errors.New("could not set FTP path:" + err.Error())
+		}
+	}
+	err = c.g.sendCommand("AT+FTPPUT=1")
+	if err != nil {
+		return nil, errors.New("could not execute FTP PUT:" + err.Error())
+	}
+	w := &ftpWriter{c: c}
+	err = w.waitForReady()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ftpReader reads a download from the module in chunks (AT+FTPGET=2).
+type ftpReader struct {
+	c        *FTPClient
+	finished bool
+	eof      bool
+	closed   bool
+}
+
+var ftpGetDataRegexp = regexp.MustCompile(`^\+FTPGET: 2,([0-9]+)$`)
+var ftpGetRegexp = regexp.MustCompile(`^\+FTPGET: 1,([0-9]+)$`)
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read on closed FTP download")
+	}
+	if r.eof {
+		return 0, io.EOF
+	}
+	g := r.c.g
+	for {
+		size := len(p)
+		if size > ftpChunkSize {
+			size = ftpChunkSize
+		}
+		err := g.sendCommand(fmt.Sprintf("AT+FTPGET=2,%d", size))
+		if err != nil {
+			return 0, errors.New("could not read FTP data:" + err.Error())
+		}
+		var s []string
+		for s == nil {
+			m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+FTPGET: .*|%s)$`,
+				string(ErrorResponse))), ftpTimeout)
+			if err != nil {
+				return 0, errors.New("could not read FTP data:" + err.Error())
+			}
+			if m == string(ErrorResponse) {
+				return 0, errors.New("could not read FTP data")
+			}
+			if status := ftpGetRegexp.FindStringSubmatch(m); status != nil {
+				// a status notification may arrive before the data
+				err := r.handleStatus(status[1])
+				if err != nil {
+					return 0, err
+				}
+				continue
+			}
+			s = ftpGetDataRegexp.FindStringSubmatch(m)
+		}
+		n, _ := strconv.Atoi(s[1])
+		data, err := g.readBytes(n, 10*time.Second)
+		if err != nil {
+			return 0, errors.New("could not read FTP data:" + err.Error())
+		}
+		_, err = g.waitForLine(okRegexp, 5*time.Second)
+		if err != nil {
+			return 0, errors.New("could not read FTP data:" + err.Error())
+		}
+		if n > 0 {
+			g.accountTraffic(n, 0)
+			return copy(p, data), nil
+		}
+		if r.finished {
+			r.eof = true
+			return 0, io.EOF
+		}
+		// wait for more data to arrive, or for the download to finish
+		m, err := g.waitForLine(ftpGetRegexp, ftpTimeout)
+		if err != nil {
+			return 0, errors.New("could not read FTP data:" + err.Error())
+		}
+		err = r.handleStatus(ftpGetRegexp.FindStringSubmatch(m)[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// handleStatus processes a "+FTPGET: 1,<code>" notification, where 1 announces more data and 0 the end of the
+// download.
+func (r *ftpReader) handleStatus(status string) error {
+	code, _ := strconv.Atoi(status)
+	switch code {
+	case 0:
+		r.finished = true
+	case 1:
+	default:
+		return FTPError{Op: "GET", Code: FTPErrorCode(code)}
+	}
+	return nil
+}
+
+func (r *ftpReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	defer r.c.mu.Unlock()
+	if !r.finished {
+		// abort the download
+		err := r.c.g.executeATCommand("AT+FTPQUIT")
+		if err != nil {
+			log.Debug().Err(err).Msg("could not abort FTP download")
+		}
+	}
+	return nil
+}
+
+// ftpWriter writes an upload to the module in chunks (AT+FTPPUT=2).
+type ftpWriter struct {
+	c      *FTPClient
+	maxLen int
+	closed bool
+}
+
+// waitForReady waits until the module is ready to accept more data, and records how much it accepts at once.
+func (w *ftpWriter) waitForReady() error {
+	m, err := w.c.g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+FTPPUT: 1,.*|%s)$`,
+		string(ErrorResponse))), ftpTimeout)
+	if err != nil {
+		return errors.New("could not write FTP data:" + err.Error())
+	}
+	s := ftpPutRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return errors.New("could not write FTP data: " + m)
+	}
+	code, _ := strconv.Atoi(s[1])
+	if code != 1 {
+		return FTPError{Op: "PUT", Code: FTPErrorCode(code)}
+	}
+	w.maxLen, _ = strconv.Atoi(s[3])
+	if w.maxLen <= 0 {
+		w.maxLen = ftpChunkSize
+	}
+	return nil
+}
+
+func (w *ftpWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write on closed FTP upload")
+	}
+	g := w.c.g
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > w.maxLen {
+			chunk = chunk[:w.maxLen]
+		}
+		err := g.sendCommand(fmt.Sprintf("AT+FTPPUT=2,%d", len(chunk)))
+		if err != nil {
+			return written, errors.New("could not write FTP data:" + err.Error())
+		}
+		_, err = g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^\+FTPPUT: 2,%d$`, len(chunk))), ftpTimeout)
+		if err != nil {
+			return written, errors.New("could not write FTP data:" + err.Error())
+		}
+		err = g.writeConfirmed(chunk)
+		if err != nil {
+			return written, errors.New("could not write FTP data:" + err.Error())
+		}
+		g.accountTraffic(0, len(chunk))
+		written += len(chunk)
+		err = w.waitForReady()
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close completes the upload.
+func (w *ftpWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.mu.Unlock()
+	err := w.c.g.executeATCommand("AT+FTPPUT=2,0")
+	if err != nil {
+		return errors.New("could not complete FTP upload:" + err.Error())
+	}
+	_, _, err = w.c.waitForResult("PUT")
+	return err
+}
@@ -4,7 +4,11 @@ go 1.12
 
 require (
 	github.com/argandas/serial v0.0.0-20160316175758-889a5ad85462
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/klauspost/compress v1.11.13
 	github.com/oklog/ulid v1.3.1
 	github.com/rs/zerolog v1.14.3
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 	periph.io/x/periph v3.4.0+incompatible
 )
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"io"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,36 +14,64 @@ import (
 
 // OpenTcpConnection attempts to establish a new connection to the given IP and port.
 func (g *DefaultGsmModule) OpenTcpConnection(address string) error {
-	addressParts := strings.Split(address, ":")
-	ip := strings.TrimSpace(addressParts[0])
-	port := strings.TrimSpace(addressParts[1])
-	connStr := fmt.Sprintf(string(ConnectCommand), ip, port)
+	return g.openSocket(ConnectCommand, address)
+}
+
+// OpenUdpConnection sets up a UDP connection to the given IP and port, to which datagrams are sent.
+func (g *DefaultGsmModule) OpenUdpConnection(address string) error {
+	return g.openSocket(ConnectUDPCommand, address)
+}
+
+func (g *DefaultGsmModule) openSocket(command Command, address string) error {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(address))
+	if err != nil {
+		return errors.New("could not open connection:" + err.Error())
+	}
+	connStr := fmt.Sprintf(string(command), host, port)
 	// send the connect command
-	err := g.sp.Println(connStr)
+	err = g.sendCommand(connStr)
 	if err != nil {
 		return errors.New("could not open connection:" + err.Error())
 	}
 	// First phase
 	log.Debug().Msg("waiting for OK")
-	m, err := g.sp.WaitForRegexTimeout(
-		fmt.Sprintf("%s|%s",
-			string(OkResponse),
-			string(ErrorResponse)), 5*time.Second)
+	m, err := g.waitForLine(resultRegexp, 5*time.Second)
 	if err != nil {
 		return err
 	}
-	if m == string(OkResponse) {
+	if m == string(OkResponse) && g.transparent {
+		// Second phase
+		log.Debug().Msg("waiting for CONNECT")
+		m, err = g.waitForLine(regexp.MustCompile(
+			fmt.Sprintf("^(%s|%s|%s|%s)$",
+				string(ConnectResponse),
+				string(AlreadyConnectedResponse),
+				string(ConnectFailedResponse),
+				string(StateTcpClosedResponse))), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		if m == string(ConnectResponse) || m == string(AlreadyConnectedResponse) {
+			g.dataMode = true
+			g.lastDataTime = time.Now()
+			g.resetConnectionState()
+			return nil
+		}
+		return errors.New(m)
+	} else if m == string(OkResponse) {
 		// Second phase
 		log.Debug().Msg("waiting for CONNECT OK")
-		m, err = g.sp.WaitForRegexTimeout(
-			fmt.Sprintf("%s|%s|%s",
+		m, err = g.waitForLine(regexp.MustCompile(
+			fmt.Sprintf("^(%s|%s|%s|%s)$",
 				string(ConnectOkResponse),
 				string(AlreadyConnectedResponse),
-				string(StateTcpClosedResponse)), 5*time.Second)
+				string(ConnectFailedResponse),
+				string(StateTcpClosedResponse))), 5*time.Second)
 		if err != nil {
 			return err
 		}
 		if m == string(ConnectOkResponse) || m == string(AlreadyConnectedResponse) {
+			g.resetConnectionState()
 			return nil
 		} else {
 			return errors.New(m)
@@ -49,10 +79,11 @@ func (g *DefaultGsmModule) OpenTcpConnection(address string) error {
 	} else {
 		// Second phase
 		log.Debug().Msg("waiting for CONNECT FAIL or TCP CLOSED")
-		m, err = g.sp.WaitForRegexTimeout(
-			fmt.Sprintf("%s|%s",
+		m, err = g.waitForLine(regexp.MustCompile(
+			fmt.Sprintf("^(%s|%s|%s)$",
 				string(ConnectFailedResponse),
-				string(StateTcpClosedResponse)), 5*time.Second)
+				string(AlreadyConnectedResponse),
+				string(StateTcpClosedResponse))), 5*time.Second)
 		if err != nil {
 			return err
 		}
@@ -60,58 +91,74 @@ func (g *DefaultGsmModule) OpenTcpConnection(address string) error {
 	}
 }
 
-// GetLocalIPAddress
+// GetLocalIPAddress queries the IP address assigned to the module (AT+CIFSR). The address is cached for the
+// connections' LocalAddr.
 func (g *DefaultGsmModule) GetLocalIPAddress() (string, error) {
-	err := g.sp.Println(string(GetLocalIPAddressCommand))
+	err := g.sendCommand(string(GetLocalIPAddressCommand))
 	if err != nil {
 		log.Error().Err(err)
 		return "", err
 	}
-	ip, err := g.sp.WaitForRegexTimeout("[0-9]{1,3}[.][0-9]{1,3}[.][0-9]{1,3}[.][0-9]{1,3}", 3*time.Second)
+	ip, err := g.waitForLine(localIPRegexp, 3*time.Second)
 	if err != nil {
 		return "", err
 	}
+	g.localIP = net.ParseIP(ip)
 	return ip, nil
 }
 
+var localIPRegexp = regexp.MustCompile(`^[0-9]{1,3}[.][0-9]{1,3}[.][0-9]{1,3}[.][0-9]{1,3}$`)
+var connectionStateRegexp = regexp.MustCompile(`^STATE: .*$`)
+
 // IsConnected determines if a connection is currently established.
 func (g *DefaultGsmModule) IsConnected() (bool, error) {
 	// send the connect command
-	err := g.sp.Println(string(ConnectionStateCommand))
+	err := g.sendCommand(string(ConnectionStateCommand))
 	if err != nil {
 		return false, errors.New("could not determine connection state:" + err.Error())
 	}
 	// First phase
-	m, err := g.sp.WaitForRegexTimeout(
-		fmt.Sprintf("%s|%s",
-			string(OkResponse),
-			string(ErrorResponse)), 5*time.Second)
+	m, err := g.waitForLine(resultRegexp, 5*time.Second)
 	if err != nil {
 		return false, err
 	}
 	if m == string(OkResponse) {
-		m, err = g.sp.WaitForRegexTimeout(
-			fmt.Sprintf("%s",
-				string(StateConnectOkResponse)), 5*time.Second)
+		m, err = g.waitForLine(connectionStateRegexp, 5*time.Second)
 		if err != nil {
 			return false, err
 		}
-		return true, nil
+		return m == string(StateConnectOkResponse), nil
 	} else {
 		return false, errors.New(m)
 	}
 }
 
-// SendRawTcpData sends the given data to to open connection.
+// SendRawTcpData sends the given data to to open connection. In quick send mode, io.ErrShortWrite is returned with
+// the number of bytes accepted if the module did not accept all of them.
 func (g *DefaultGsmModule) SendRawTcpData(data []byte) (int, error) {
+	return g.sendRawTcpData(data, time.Time{})
+}
+
+// sendRawTcpData sends the data as SendRawTcpData does, waiting for the module no longer than the deadline. Once the
+// deadline has passed TimedOutErr is returned, with the number of bytes already handed to the module.
+func (g *DefaultGsmModule) sendRawTcpData(data []byte, deadline time.Time) (int, error) {
 	sendTimeout := time.Duration(getConfigValue(SendTimeoutConfig, g.configs...).(SendTimeout))
-	err := g.sp.Println(fmt.Sprintf("%s?", string(SendCommand)))
-	match, err := g.sp.WaitForRegexTimeout("\\+CIPSEND: [0-9]+", sendTimeout)
+	wait, err := waitUntil(deadline, sendTimeout)
+	if err != nil {
+		return 0, err
+	}
+	err = g.sendCommand(fmt.Sprintf("%s?", string(SendCommand)))
 	if err != nil {
 		return -1, err
 	}
-	matches := regexp.MustCompile("\\+CIPSEND: ([0-9]+)").FindAllStringSubmatch(match, -1)
-	maxBytes, err := strconv.Atoi(matches[0][1])
+	match, err := g.waitForLine(sendLengthRegexp, wait)
+	if err != nil {
+		return -1, deadlineErr(deadline, err)
+	}
+	if match == string(ErrorResponse) {
+		return -1, g.sendErr()
+	}
+	maxBytes, err := strconv.Atoi(sendLengthRegexp.FindStringSubmatch(match)[2])
 	if err != nil {
 		log.Error().Err(err)
 		return -1, err
@@ -125,21 +172,47 @@ func (g *DefaultGsmModule) SendRawTcpData(data []byte) (int, error) {
 		maxBytesReached = true
 	}
 	// send the 'send' command
-	err = g.sp.Println(fmt.Sprintf("%s=%d", string(SendCommand), bytesToWrite))
+	err = g.sendCommand(fmt.Sprintf("%s=%d", string(SendCommand), bytesToWrite))
 	if err != nil {
 		return -1, err
 	}
 	time.Sleep(10 * time.Millisecond)
-	sendData := append(dataToWrite)
 	// send the actual data
-	_, err = g.sp.Write(sendData)
+	_, err = g.sp.Write(dataToWrite)
 	if err != nil {
 		return -1, err
 	}
-	_, err = g.sp.WaitForRegexTimeout(fmt.Sprintf("%s",
-		string(SendOkResponse)), sendTimeout)
+	// the data has been handed to the module, so only the confirmation is bounded by the deadline
+	wait, err = waitUntil(deadline, sendTimeout)
 	if err != nil {
-		return -1, err
+		g.unconfirmed++
+		return bytesToWrite, err
+	}
+	if g.quickSend {
+		m, err := g.waitForLine(sendResultRegexp, wait)
+		if err != nil {
+			return bytesToWrite, g.abandonSend(deadline, err)
+		}
+		s := dataAcceptRegexp.FindStringSubmatch(m)
+		if s == nil {
+			return -1, g.sendErr()
+		}
+		// the module reports how many bytes it accepted for sending
+		accepted, err := strconv.Atoi(s[1])
+		if err != nil {
+			return -1, err
+		}
+		if accepted < bytesToWrite {
+			return accepted, io.ErrShortWrite
+		}
+	} else {
+		m, err := g.waitForLine(sendResultRegexp, wait)
+		if err != nil {
+			return bytesToWrite, g.abandonSend(deadline, err)
+		}
+		if m != string(SendOkResponse) {
+			return -1, g.sendErr()
+		}
 	}
 	if maxBytesReached {
 		return bytesToWrite, MaxBytesErr{}
@@ -147,24 +220,313 @@ func (g *DefaultGsmModule) SendRawTcpData(data []byte) (int, error) {
 	return bytesToWrite, err
 }
 
+// deadlineErr replaces the error of a wait for the module with TimedOutErr if the deadline has passed.
+func deadlineErr(deadline time.Time, err error) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return TimedOutErr{}
+	}
+	return err
+}
+
+// abandonSend gives up waiting for the confirmation of a send, which is dropped when it arrives later.
+func (g *DefaultGsmModule) abandonSend(deadline time.Time, err error) error {
+	if _, ok := err.(TimedOutErr); ok {
+		g.unconfirmed++
+	}
+	return deadlineErr(deadline, err)
+}
+
+// sendErr returns the error of a send that the module refused, io.EOF if the peer has closed the connection.
+func (g *DefaultGsmModule) sendErr() error {
+	if g.peerClosed {
+		return io.EOF
+	}
+	return errors.New("could not send data")
+}
+
+// SetQuickSend switches quick send mode (AT+CIPQSEND) on or off.
+func (g *DefaultGsmModule) SetQuickSend(enabled bool) error {
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(QuickSendCommand), mode))
+	if err != nil {
+		return errors.New("could not set quick send mode:" + err.Error())
+	}
+	g.quickSend = enabled
+	return nil
+}
+
+// Acknowledgement describes how much of the data sent on the current connection has been acknowledged by the peer.
+type Acknowledgement struct {
+	// Sent is the number of bytes sent.
+	Sent int
+	// Acknowledged is the number of bytes acknowledged by the peer.
+	Acknowledged int
+	// Unacknowledged is the number of bytes not yet acknowledged by the peer.
+	Unacknowledged int
+}
+
+var sendLengthRegexp = regexp.MustCompile(`^(\+CIPSEND: ([0-9]+)|` + string(ErrorResponse) + `)$`)
+var dataAcceptRegexp = regexp.MustCompile(string(DataAcceptResponse) + `: ?([0-9]+)`)
+var sendResultRegexp = regexp.MustCompile(fmt.Sprintf("^(%s|%s: ?[0-9]+|SEND FAIL|%s)$",
+	string(SendOkResponse),
+	string(DataAcceptResponse),
+	string(ErrorResponse)))
+var acknowledgementRegexp = regexp.MustCompile(`\+CIPACK: ([0-9]+),([0-9]+),([0-9]+)`)
+
+// GetAcknowledgement queries the data transmitting state of the current connection (AT+CIPACK).
+func (g *DefaultGsmModule) GetAcknowledgement() (Acknowledgement, error) {
+	err := g.sendCommand(string(AcknowledgementCommand))
+	if err != nil {
+		return Acknowledgement{}, errors.New("could not query acknowledgement:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf("^(%s|%s)$",
+		acknowledgementRegexp.String(),
+		string(ErrorResponse))), 5*time.Second)
+	if err != nil {
+		return Acknowledgement{}, err
+	}
+	s := acknowledgementRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return Acknowledgement{}, errors.New(m)
+	}
+	var values [3]int
+	for i := range values {
+		values[i], err = strconv.Atoi(s[i+1])
+		if err != nil {
+			return Acknowledgement{}, err
+		}
+	}
+	_, err = g.waitForLine(okRegexp, 5*time.Second)
+	if err != nil {
+		return Acknowledgement{}, err
+	}
+	return Acknowledgement{
+		Sent:           values[0],
+		Acknowledged:   values[1],
+		Unacknowledged: values[2],
+	}, nil
+}
+
 func (g *DefaultGsmModule) ReadData() (byte, error) {
 	return g.sp.Read()
 }
 
+// configureReceiveHeader makes the module prefix the data it forwards with its length (AT+CIPHEAD), so that data is
+// told apart from responses and notices. Only data forwarded as it arrives needs the header.
+func (g *DefaultGsmModule) configureReceiveHeader() error {
+	enabled := !g.transparent && !g.manualReceive
+	if enabled == g.ipHeader {
+		return nil
+	}
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(HeaderCommand), mode))
+	if err != nil {
+		return errors.New("could not set receive header:" + err.Error())
+	}
+	g.ipHeader = enabled
+	return nil
+}
+
+// resetConnectionState clears the state of the previous connection once a new one has been established.
+func (g *DefaultGsmModule) resetConnectionState() {
+	g.peerClosed = false
+	g.pending = nil
+	g.dataAvailable = true
+	g.unconfirmed = 0
+}
+
+// pollRaw returns the data that the module has forwarded, waiting for it no longer than the given time. It returns
+// io.EOF once the peer has closed the connection and the data before has been read.
+func (g *DefaultGsmModule) pollRaw(b []byte, wait time.Duration) (int, error) {
+	if len(g.pending) == 0 && !g.peerClosed {
+		line, err := g.scanLine(wait, true)
+		if _, ok := err.(TimedOutErr); !ok && err != nil {
+			return 0, err
+		}
+		if line != "" {
+			log.Debug().Msgf("ignoring line: %s", line)
+		}
+	}
+	if len(g.pending) > 0 {
+		n := copy(b, g.pending)
+		g.pending = g.pending[n:]
+		return n, nil
+	}
+	if g.peerClosed {
+		return 0, io.EOF
+	}
+	return 0, nil
+}
+
+// pollBuffered retrieves the data held by the module in manual receive mode. If the module has not notified that
+// data has arrived, it waits for the notification no longer than the given time.
+func (g *DefaultGsmModule) pollBuffered(b []byte, wait time.Duration) (int, error) {
+	if !g.dataAvailable && !g.peerClosed {
+		line, err := g.readLine(wait)
+		if _, ok := err.(TimedOutErr); !ok && err != nil {
+			return 0, err
+		}
+		if line != "" && line != string(DataAvailableResponse) && line != string(ClosedResponse) {
+			log.Debug().Msgf("ignoring line: %s", line)
+		}
+		if !g.dataAvailable && !g.peerClosed {
+			return 0, nil
+		}
+	}
+	data, err := g.ReceiveData(len(b))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		g.dataAvailable = false
+		return 0, nil
+	}
+	return copy(b, data), nil
+}
+
+// maxReceiveLength is the largest chunk that can be retrieved with a single AT+CIPRXGET=2.
+const maxReceiveLength = 1460
+
+var receiveDataRegexp = regexp.MustCompile(`^\+CIPRXGET: 2,([0-9]+),([0-9]+)$`)
+var receiveDataLengthRegexp = regexp.MustCompile(`^\+CIPRXGET: 4,([0-9]+)$`)
+var okRegexp = regexp.MustCompile("^" + string(OkResponse) + "$")
+
+// SetManualReceive switches buffered receive mode (AT+CIPRXGET) on or off. It must be set before a connection
+// is opened.
+func (g *DefaultGsmModule) SetManualReceive(enabled bool) error {
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(ReceiveModeCommand), mode))
+	if err != nil {
+		return errors.New("could not set receive mode:" + err.Error())
+	}
+	g.manualReceive = enabled
+	return nil
+}
+
+// ReceiveData retrieves up to max bytes of the data buffered by the module in manual receive mode. An empty
+// slice is returned if no data is buffered, and io.EOF once the connection has been closed and the buffered data
+// has been read.
+func (g *DefaultGsmModule) ReceiveData(max int) ([]byte, error) {
+	if max > maxReceiveLength {
+		max = maxReceiveLength
+	}
+	err := g.sendCommand(fmt.Sprintf(string(ReceiveDataCommand), max))
+	if err != nil {
+		return nil, errors.New("could not receive data:" + err.Error())
+	}
+	for {
+		line, err := g.readLine(5 * time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if line == string(ErrorResponse) {
+			if g.peerClosed {
+				return nil, io.EOF
+			}
+			return nil, errors.New("could not receive data")
+		}
+		s := receiveDataRegexp.FindStringSubmatch(line)
+		if s == nil {
+			// notifications and echoes are not part of the payload
+			continue
+		}
+		n, err := strconv.Atoi(s[1])
+		if err != nil {
+			return nil, err
+		}
+		data, err := g.readBytes(n, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		_, err = g.waitForLine(okRegexp, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 && g.peerClosed {
+			return nil, io.EOF
+		}
+		return data, nil
+	}
+}
+
+// ReceivedDataLength queries the number of bytes buffered by the module in manual receive mode.
+func (g *DefaultGsmModule) ReceivedDataLength() (int, error) {
+	err := g.sendCommand(string(ReceiveDataLengthCommand))
+	if err != nil {
+		return 0, errors.New("could not query received data length:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+CIPRXGET: 4,[0-9]+|%s|%s)$`,
+		string(ErrorResponse),
+		string(ClosedResponse))), 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	s := receiveDataLengthRegexp.FindStringSubmatch(m)
+	if s == nil {
+		if m == string(ClosedResponse) {
+			return 0, io.EOF
+		}
+		return 0, errors.New(m)
+	}
+	n, err := strconv.Atoi(s[1])
+	if err != nil {
+		return 0, err
+	}
+	_, err = g.waitForLine(okRegexp, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// WaitForData waits for the module to notify that new data has been buffered in manual receive mode. It
+// returns io.EOF if the connection is closed in the meantime.
+func (g *DefaultGsmModule) WaitForData(timeout time.Duration) error {
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf("^(%s|%s)$",
+		regexp.QuoteMeta(string(DataAvailableResponse)),
+		string(ClosedResponse))), timeout)
+	if err != nil {
+		return err
+	}
+	if m == string(ClosedResponse) {
+		return io.EOF
+	}
+	return nil
+}
+
 // CloseTcpConnection closes the current connection.
 func (g *DefaultGsmModule) CloseTcpConnection() error {
+	if g.dataMode {
+		err := g.EnterCommandMode()
+		if err != nil {
+			return errors.New("could not close connection:" + err.Error())
+		}
+	}
 	// send the connect command
-	err := g.sp.Println(string(DisconnectCommand))
+	err := g.sendCommand(string(DisconnectCommand))
 	if err != nil {
 		return errors.New("could not close connection:" + err.Error())
 	}
-	m, err := g.sp.WaitForRegexTimeout(fmt.Sprintf("%s|%s",
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf("^(%s|%s)$",
 		string(CloseOkResponse),
-		string(ErrorResponse)), 3*time.Second)
+		string(ErrorResponse))), 3*time.Second)
 	if err != nil {
 		return err
 	}
 	if m != string(CloseOkResponse) {
+		if g.peerClosed {
+			// the peer has already closed the connection
+			return nil
+		}
 		return errors.New(m)
 	}
 	return nil
@@ -5,15 +5,24 @@ import (
 	"fmt"
 	"github.com/argandas/serial"
 	"github.com/rs/zerolog/log"
+	"io"
+	"net"
 	"periph.io/x/periph/conn/gpio"
 	"periph.io/x/periph/conn/gpio/gpioreg"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // NewGsmModule opens a serial connection to the provided serial device.
 func NewGsmModule(device string, configs ...Config) (*DefaultGsmModule, error) {
 	verbose := getConfigValue(VerboseConfig, configs...).(Verbose)
+	cycleDay := int(getConfigValue(BillingCycleDayConfig, configs...).(BillingCycleDay))
+	if cycleDay < 1 || cycleDay > 28 {
+		return nil, errors.New("billing cycle day must be between 1 and 28")
+	}
 	// open the serial port
 	sp := serial.New()
 	baudConfig := getConfigValue(BaudConfig, configs...)
@@ -26,6 +35,7 @@ func NewGsmModule(device string, configs ...Config) (*DefaultGsmModule, error) {
 		device:  device,
 		sp:      sp,
 		configs: configs,
+		usage:   newUsageMeter(string(getConfigValue(UsageFileConfig, configs...).(UsageFile)), cycleDay),
 	}
 	return g, nil
 }
@@ -82,6 +92,11 @@ func (g *DefaultGsmModule) Shutdown() error {
 	if !off {
 		return errors.New("GSM module not off")
 	}
+	g.localIP = nil
+	err = g.SaveUsage()
+	if err != nil {
+		log.Error().Err(err).Msg("could not save usage")
+	}
 	g.CloseGsmModule()
 	time.Sleep(1 * time.Second)
 	return nil
@@ -95,19 +110,64 @@ func (g *DefaultGsmModule) CloseGsmModule() {
 	}
 }
 
+// serialPort is the serial line to the module, as provided by *serial.SerialPort.
+type serialPort interface {
+	Println(str string) error
+	Write(data []byte) (int, error)
+	Read() (byte, error)
+	WaitForRegexTimeout(exp string, timeout time.Duration) (string, error)
+	Close() error
+}
+
 type DefaultGsmModule struct {
-	sp            *serial.SerialPort
+	sp            serialPort
 	device        string
 	configs       []Config
+	usage         *usageMeter
+	manualReceive bool
+	ssl           bool
+	quickSend     bool
+	transparent   bool
+	dataMode      bool
+	lastDataTime  time.Time
+	// peerClosed is set once the module reports that the peer has closed the connection
+	peerClosed bool
+	// pending holds data read from the serial line that has not been returned to the connection yet
+	pending   []byte
+	localIP   net.IP
+	keepAlive time.Duration
+	// noTCPKeepAlive is set once the module has rejected AT+CIPTKA, after which connections are not configured with
+	// it again
+	noTCPKeepAlive bool
+	// mu serialises the exchanges of a connection with the module, so that its reads, writes and heartbeat do not
+	// interleave their commands and responses
+	mu sync.Mutex
+	// ipHeader is set while the module prefixes received data with +IPD,<length>: (AT+CIPHEAD)
+	ipHeader bool
+	// line holds the part of a line received before a read timed out
+	line []byte
+	// dataAvailable is set once the module notifies that it holds received data in manual receive mode
+	dataAvailable bool
+	// connOpen is set while a connection opened on the module has not been closed
+	connOpen bool
+	// unconfirmed counts the sends whose confirmation was not waited for because the write deadline passed
+	unconfirmed int
+	// Deprecated: TotalDeadline is ignored; use Conn.SetDeadline instead.
 	TotalDeadline time.Time
-	ReadDeadline  time.Time
+	// Deprecated: ReadDeadline is ignored; use Conn.SetReadDeadline instead.
+	ReadDeadline time.Time
+	// Deprecated: WriteDeadline is ignored; use Conn.SetWriteDeadline instead.
 	WriteDeadline time.Time
 }
 
+// serialPollInterval is the delay between polls of an empty serial buffer.
+const serialPollInterval = 5 * time.Millisecond
+
 type Command string
 
 const StatusCommand Command = `AT`
 const ConnectCommand Command = `AT+CIPSTART="TCP", "%s", "%s"`
+const ConnectUDPCommand Command = `AT+CIPSTART="UDP", "%s", "%s"`
 const DisconnectCommand Command = `AT+CIPCLOSE`
 const SendCommand Command = `AT+CIPSEND`
 const ConnectionStateCommand Command = `AT+CIPSTATUS`
@@ -115,6 +175,38 @@ const CheckNetworkRegistrationCommand Command = `AT+CGREG?`
 const GetLocalIPAddressCommand Command = `AT+CIFSR`
 const EchoOffCommand Command = `ATE0`
 const EchoOnCommand Command = `ATE1`
+const TransparentModeCommand Command = `AT+CIPMODE=%d`
+const ResumeDataModeCommand Command = `ATO`
+const QuickSendCommand Command = `AT+CIPQSEND=%d`
+const AcknowledgementCommand Command = `AT+CIPACK`
+const SSLCommand Command = `AT+CIPSSL=%d`
+const ReceiveModeCommand Command = `AT+CIPRXGET=%d`
+const ReceiveDataCommand Command = `AT+CIPRXGET=2,%d`
+const HeaderCommand Command = `AT+CIPHEAD=%d`
+const ReceiveDataLengthCommand Command = `AT+CIPRXGET=4`
+const TCPKeepAliveCommand Command = `AT+CIPTKA=%d,%d,%d,%d`
+const ServerCommand Command = `AT+CIPSERVER=1,%d`
+const StopServerCommand Command = `AT+CIPSERVER=0`
+const PingCommand Command = `AT+CIPPING="%s",%d,%d,%d`
+const BearerConfigCommand Command = `AT+SAPBR=3,%d,"%s","%s"`
+const BearerOpenCommand Command = `AT+SAPBR=1,%d`
+const BearerCloseCommand Command = `AT+SAPBR=0,%d`
+const BearerQueryCommand Command = `AT+SAPBR=2,%d`
+const NetworkTimeBearerCommand Command = `AT+CNTPCID=%d`
+const NetworkTimeServerCommand Command = `AT+CNTP="%s",%d`
+const NetworkTimeSyncCommand Command = `AT+CNTP`
+const ClockCommand Command = `AT+CCLK?`
+const SetClockCommand Command = `AT+CCLK="%s"`
+const LocalTimestampCommand Command = `AT+CLTS=%d`
+const TimeZoneUpdateCommand Command = `AT+CTZU=%d`
+const HTTPInitCommand Command = `AT+HTTPINIT`
+const HTTPTerminateCommand Command = `AT+HTTPTERM`
+const HTTPParameterCommand Command = `AT+HTTPPARA="%s","%s"`
+const HTTPSSLCommand Command = `AT+HTTPSSL=%d`
+const HTTPDataCommand Command = `AT+HTTPDATA=%d,%d`
+const HTTPActionCommand Command = `AT+HTTPACTION=%d`
+const HTTPHeadCommand Command = `AT+HTTPHEAD`
+const HTTPReadCommand Command = `AT+HTTPREAD=%d,%d`
 
 type ResponseMessage string
 
@@ -127,6 +219,12 @@ const StateTcpClosedResponse ResponseMessage = "STATE: TCP CLOSED"
 const StateConnectOkResponse ResponseMessage = "STATE: CONNECT OK"
 const ConnectFailedResponse ResponseMessage = "CONNECT FAIL"
 const SendOkResponse ResponseMessage = "SEND OK"
+const DataAcceptResponse ResponseMessage = "DATA ACCEPT"
+const ConnectResponse ResponseMessage = "CONNECT"
+const NoCarrierResponse ResponseMessage = "NO CARRIER"
+const ClosedResponse ResponseMessage = "CLOSED"
+const DataAvailableResponse ResponseMessage = "+CIPRXGET: 1"
+const PDPDeactivatedResponse ResponseMessage = "+PDP: DEACT"
 
 type NetworkRegistrationStatus string
 
@@ -137,16 +235,27 @@ const RegistrationDenied NetworkRegistrationStatus = "3"
 const UnknownRegistrationError NetworkRegistrationStatus = "4"
 const RegisteredRoaming NetworkRegistrationStatus = "5"
 
+// sendCommand writes an AT command to the module. Commands are refused while the module is in data mode.
+func (g *DefaultGsmModule) sendCommand(cmd string) error {
+	if g.dataMode {
+		return DataModeErr{}
+	}
+	g.usage.add(Usage{CommandOverhead: int64(len(cmd) + 2)})
+	return g.sp.Println(cmd)
+}
+
+var resultRegexp = regexp.MustCompile(fmt.Sprintf(`^(%s|%s|\+CM[ES] %s: .*)$`,
+	string(OkResponse),
+	string(ErrorResponse),
+	string(ErrorResponse)))
+
 func (g *DefaultGsmModule) executeATCommand(cmd string) error {
-	err := g.sp.Println(cmd)
+	err := g.sendCommand(cmd)
 	if err != nil {
 		return errors.New("could set multi connection:" + err.Error())
 	}
 	log.Debug().Msg("waiting for OK")
-	m, err := g.sp.WaitForRegexTimeout(
-		fmt.Sprintf("%s|%s",
-			string(OkResponse),
-			string(ErrorResponse)), 5*time.Second)
+	m, err := g.waitForLine(resultRegexp, 5*time.Second)
 	if err != nil {
 		log.Error().Msgf(err.Error())
 		return err
@@ -158,6 +267,185 @@ func (g *DefaultGsmModule) executeATCommand(cmd string) error {
 	return errors.New(m)
 }
 
+var receivedDataHeaderRegexp = regexp.MustCompile(`^\+IPD,([0-9]+)$`)
+
+// readLine reads the next non-empty line from the serial buffer, without the line ending. A partial line is kept
+// when the timeout expires, and completed by the next read.
+func (g *DefaultGsmModule) readLine(timeout time.Duration) (string, error) {
+	return g.scanLine(timeout, false)
+}
+
+// scanLine reads the next line as readLine does. While the module prefixes received data with a header, the data
+// is moved to the pending data instead; if stopOnData is set, an empty line is then returned so that the data can
+// be delivered without waiting for the next line.
+func (g *DefaultGsmModule) scanLine(timeout time.Duration, stopOnData bool) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		b, err := g.sp.Read()
+		if err == io.EOF {
+			if time.Now().After(deadline) {
+				return "", TimedOutErr{}
+			}
+			time.Sleep(serialPollInterval)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\r':
+		case '\n':
+			if len(g.line) == 0 {
+				continue
+			}
+			line := string(g.line)
+			g.line = g.line[:0]
+			if g.handleNotice(line) {
+				continue
+			}
+			return line, nil
+		case ':':
+			s := receivedDataHeaderRegexp.FindSubmatch(g.line)
+			if !g.ipHeader || s == nil {
+				g.line = append(g.line, b)
+				continue
+			}
+			g.line = g.line[:0]
+			n, err := strconv.Atoi(string(s[1]))
+			if err != nil {
+				return "", err
+			}
+			data, err := g.readBytes(n, 5*time.Second)
+			g.pending = append(g.pending, data...)
+			if err != nil {
+				return "", err
+			}
+			if stopOnData {
+				return "", nil
+			}
+		default:
+			g.line = append(g.line, b)
+		}
+	}
+}
+
+// handleNotice records the unsolicited notices of the connection, reporting whether the line should be dropped.
+func (g *DefaultGsmModule) handleNotice(line string) bool {
+	switch line {
+	case string(ClosedResponse), string(NoCarrierResponse), string(PDPDeactivatedResponse):
+		g.peerClosed = true
+	case string(DataAvailableResponse):
+		g.dataAvailable = true
+	case string(SendOkResponse):
+		if g.unconfirmed > 0 {
+			// the confirmation of a send whose wait was abandoned
+			g.unconfirmed--
+			return true
+		}
+	default:
+		if g.unconfirmed > 0 && dataAcceptRegexp.MatchString(line) {
+			g.unconfirmed--
+			return true
+		}
+	}
+	return false
+}
+
+// readBytes reads exactly n raw bytes from the serial buffer.
+func (g *DefaultGsmModule) readBytes(n int, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	data := make([]byte, 0, n)
+	for len(data) < n {
+		b, err := g.sp.Read()
+		if err == io.EOF {
+			if time.Now().After(deadline) {
+				return data, TimedOutErr{}
+			}
+			time.Sleep(serialPollInterval)
+			continue
+		}
+		if err != nil {
+			return data, err
+		}
+		data = append(data, b)
+	}
+	return data, nil
+}
+
+// readUntil reads from the serial buffer until one of the delimiter bytes is received, returning the text read
+// before it without carriage returns. Empty lines are skipped.
+func (g *DefaultGsmModule) readUntil(delims string, timeout time.Duration) (string, byte, error) {
+	deadline := time.Now().Add(timeout)
+	var token []byte
+	for {
+		b, err := g.sp.Read()
+		if err == io.EOF {
+			if time.Now().After(deadline) {
+				return "", 0, TimedOutErr{}
+			}
+			time.Sleep(serialPollInterval)
+			continue
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		switch {
+		case b == '\r':
+		case b == '\n' && len(token) == 0:
+		case strings.IndexByte(delims, b) >= 0:
+			return string(token), b, nil
+		default:
+			token = append(token, b)
+		}
+	}
+}
+
+// waitForPrompt reads from the serial buffer until the module's '>' data input prompt has been received.
+func (g *DefaultGsmModule) waitForPrompt(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var line []byte
+	for {
+		b, err := g.sp.Read()
+		if err == io.EOF {
+			if time.Now().After(deadline) {
+				return TimedOutErr{}
+			}
+			time.Sleep(serialPollInterval)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		switch b {
+		case '>':
+			return nil
+		case '\n':
+			if string(line) == string(ErrorResponse) {
+				return errors.New(string(line))
+			}
+			line = line[:0]
+		case '\r':
+		default:
+			line = append(line, b)
+		}
+	}
+}
+
+// waitForLine reads lines until one matches the given expression, discarding the rest.
+func (g *DefaultGsmModule) waitForLine(exp *regexp.Regexp, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		line, err := g.readLine(time.Until(deadline))
+		if err != nil {
+			return "", err
+		}
+		if exp.MatchString(line) {
+			return line, nil
+		}
+		log.Debug().Msgf("ignoring line: %s", line)
+	}
+}
+
 // CommandEchoOff turns off the echoing of commands
 func (g *DefaultGsmModule) CommandEchoOff() error {
 	// send the connect command
@@ -184,7 +472,7 @@ func (g *DefaultGsmModule) WaitForNetworkRegistration() error {
 	maxRetryDelay := getConfigValue(NetworkRegistrationRetryDelayConfig, g.configs...)
 	retries := 0
 	for {
-		err := g.sp.Println(string(CheckNetworkRegistrationCommand))
+		err := g.sendCommand(string(CheckNetworkRegistrationCommand))
 		if err != nil {
 			return err
 		}
@@ -216,7 +504,7 @@ func (g *DefaultGsmModule) WaitForNetworkRegistration() error {
 
 // GetStatus determines the status of the module.
 func (g *DefaultGsmModule) GetStatus() (bool, error) {
-	err := g.sp.Println(string(StatusCommand))
+	err := g.sendCommand(string(StatusCommand))
 	if err != nil {
 		log.Error().Err(err)
 		return false, err
@@ -0,0 +1,371 @@
+package gsmtcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpChunkSize is the largest amount of body data written to or read from the module at once.
+const httpChunkSize = 1024
+
+// httpActionTimeout bounds the time the module may take to perform a request.
+const httpActionTimeout = 2 * time.Minute
+
+// httpMethods maps request methods to the HTTP actions of the module.
+var httpMethods = map[string]int{
+	http.MethodGet:    0,
+	http.MethodPost:   1,
+	http.MethodHead:   2,
+	http.MethodDelete: 3,
+}
+
+// httpErrors describes the status codes used by the module to report its own failures.
+var httpErrors = map[int]string{
+	600: "not HTTP PDU",
+	601: "network error",
+	602: "no memory",
+	603: "DNS error",
+	604: "stack busy",
+}
+
+var httpActionRegexp = regexp.MustCompile(`^\+HTTPACTION: ?([0-9]+),([0-9]+),([0-9]+)$`)
+var httpHeadRegexp = regexp.MustCompile(`^\+HTTPHEAD: ?([0-9]+)$`)
+var httpReadRegexp = regexp.MustCompile(`^\+HTTPREAD: ?([0-9]+)$`)
+
+// NativeHTTPTransport is an http.RoundTripper that performs requests with the module's built-in HTTP service
+// (AT+HTTP), without opening a TCP connection through the serial line. Only GET, POST, HEAD and DELETE requests
+// are supported, and HTTPS requests use the module's SSL stack.
+//
+// The module handles one request at a time: a request waits until the response body of the previous one has been
+// closed.
+type NativeHTTPTransport struct {
+	g  *DefaultGsmModule
+	mu sync.Mutex
+}
+
+// NewNativeHTTPTransport creates a transport that uses the HTTP service of the given module.
+func NewNativeHTTPTransport(g *DefaultGsmModule) *NativeHTTPTransport {
+	return &NativeHTTPTransport{g: g}
+}
+
+func (t *NativeHTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	action, ok := httpMethods[req.Method]
+	if !ok {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("HTTP method %s is not supported by the module", req.Method)
+	}
+	t.mu.Lock()
+	resp, err := t.roundTrip(req, action)
+	if err != nil {
+		terr := t.g.executeATCommand(string(HTTPTerminateCommand))
+		if terr != nil {
+			log.Debug().Err(terr).Msg("could not terminate HTTP service")
+		}
+		t.mu.Unlock()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *NativeHTTPTransport) roundTrip(req *http.Request, action int) (*http.Response, error) {
+	g := t.g
+	err := g.OpenBearer()
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	// a previous session may not have been terminated
+	_ = g.executeATCommand(string(HTTPTerminateCommand))
+	err = g.executeATCommand(string(HTTPInitCommand))
+	if err != nil {
+		closeRequestBody(req)
+		return nil, errors.New("could not initialise HTTP service:" + err.Error())
+	}
+	err = t.setParameters(req)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	if req.Body != nil {
+		err = t.writeBody(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = g.sendCommand(fmt.Sprintf(string(HTTPActionCommand), action))
+	if err != nil {
+		return nil, errors.New("could not perform HTTP request:" + err.Error())
+	}
+	timeout := httpActionTimeout
+	if deadline, ok := req.Context().Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+HTTPACTION: .*|%s)$`,
+		string(ErrorResponse))), timeout)
+	if err != nil {
+		return nil, errors.New("could not perform HTTP request:" + err.Error())
+	}
+	s := httpActionRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return nil, errors.New("could not perform HTTP request: " + m)
+	}
+	status, _ := strconv.Atoi(s[2])
+	length, _ := strconv.ParseInt(s[3], 10, 64)
+	if msg, ok := httpErrors[status]; ok {
+		return nil, errors.New("could not perform HTTP request: " + msg)
+	}
+
+	header, err := t.readHeader()
+	if err != nil {
+		// the header is informative only, so the response is still usable
+		log.Debug().Err(err).Msg("could not read HTTP response header")
+		header = make(http.Header)
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: length,
+		Request:       req,
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		t.release()
+		return resp, nil
+	}
+	resp.Body = &nativeHTTPBody{t: t, length: length}
+	return resp, nil
+}
+
+// setParameters configures the URL, headers and SSL mode of the request.
+func (t *NativeHTTPTransport) setParameters(req *http.Request) error {
+	params := [][2]string{
+		{"CID", strconv.Itoa(bearerProfile)},
+		{"URL", req.URL.String()},
+		// redirects are followed by http.Client
+		{"REDIR", "0"},
+	}
+	var userData []string
+	for name, values := range req.Header {
+		switch textproto.CanonicalMIMEHeaderKey(name) {
+		case "Content-Type":
+			params = append(params, [2]string{"CONTENT", values[0]})
+		case "User-Agent":
+			params = append(params, [2]string{"UA", values[0]})
+		case "Content-Length":
+		default:
+			for _, v := range values {
+				userData = append(userData, name+": "+v)
+			}
+		}
+	}
+	if len(userData) > 0 {
+		// the module expands escaped line breaks between custom headers
+		params = append(params, [2]string{"USERDATA", strings.Join(userData, `\r\n`)})
+	}
+	for _, p := range params {
+		if strings.ContainsAny(p[1], "\"\r\n") {
+			return fmt.Errorf("HTTP parameter %s contains characters that cannot be sent to the module", p[0])
+		}
+		err := t.g.executeATCommand(fmt.Sprintf(string(HTTPParameterCommand), p[0], p[1]))
+		if err != nil {
+			return errors.New("could not set HTTP parameter " + p[0] + ":" + err.Error())
+		}
+	}
+	ssl := 0
+	if req.URL.Scheme == "https" {
+		ssl = 1
+	}
+	err := t.g.executeATCommand(fmt.Sprintf(string(HTTPSSLCommand), ssl))
+	if err != nil {
+		return errors.New("could not set HTTP SSL mode:" + err.Error())
+	}
+	return nil
+}
+
+// writeBody streams the request body to the module in chunks. Bodies of unknown length are buffered first, since
+// the module needs to know the size in advance.
+func (t *NativeHTTPTransport) writeBody(req *http.Request) error {
+	defer closeRequestBody(req)
+	body := req.Body
+	length := req.ContentLength
+	if length < 0 {
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		body = ioutil.NopCloser(bytes.NewReader(content))
+		length = int64(len(content))
+	}
+	if length == 0 {
+		return nil
+	}
+	err := t.g.sendCommand(fmt.Sprintf(string(HTTPDataCommand), length, int(httpActionTimeout/time.Millisecond)))
+	if err != nil {
+		return errors.New("could not send HTTP data:" + err.Error())
+	}
+	_, err = t.g.waitForLine(regexp.MustCompile("^DOWNLOAD$"), 5*time.Second)
+	if err != nil {
+		return errors.New("could not send HTTP data:" + err.Error())
+	}
+	buf := make([]byte, httpChunkSize)
+	var written int64
+	for written < length {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if written+int64(n) > length {
+				n = int(length - written)
+			}
+			_, werr := t.g.sp.Write(buf[:n])
+			if werr != nil {
+				return errors.New("could not send HTTP data:" + werr.Error())
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	t.g.accountTraffic(0, int(written))
+	if written < length {
+		return fmt.Errorf("HTTP request body is shorter than its length of %d bytes", length)
+	}
+	_, err = t.g.waitForLine(okRegexp, httpActionTimeout)
+	if err != nil {
+		return errors.New("could not send HTTP data:" + err.Error())
+	}
+	return nil
+}
+
+// readHeader reads the response header (AT+HTTPHEAD).
+func (t *NativeHTTPTransport) readHeader() (http.Header, error) {
+	err := t.g.sendCommand(string(HTTPHeadCommand))
+	if err != nil {
+		return nil, err
+	}
+	m, err := t.g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+HTTPHEAD: .*|%s)$`,
+		string(ErrorResponse))), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s := httpHeadRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return nil, errors.New(m)
+	}
+	n, _ := strconv.Atoi(s[1])
+	data, err := t.g.readBytes(n, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.g.waitForLine(okRegexp, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// skip the status line
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	_, err = reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return http.Header(header), nil
+}
+
+// release terminates the HTTP session and makes the module available for the next request.
+func (t *NativeHTTPTransport) release() {
+	err := t.g.executeATCommand(string(HTTPTerminateCommand))
+	if err != nil {
+		log.Error().Err(err).Msg("could not terminate HTTP service")
+	}
+	t.mu.Unlock()
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+// nativeHTTPBody reads the response body from the module in chunks (AT+HTTPREAD).
+type nativeHTTPBody struct {
+	t      *NativeHTTPTransport
+	length int64
+	offset int64
+	closed bool
+}
+
+func (b *nativeHTTPBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("read on closed response body")
+	}
+	if b.offset >= b.length {
+		return 0, io.EOF
+	}
+	size := len(p)
+	if size > httpChunkSize {
+		size = httpChunkSize
+	}
+	if remaining := b.length - b.offset; int64(size) > remaining {
+		size = int(remaining)
+	}
+	g := b.t.g
+	err := g.sendCommand(fmt.Sprintf(string(HTTPReadCommand), b.offset, size))
+	if err != nil {
+		return 0, errors.New("could not read HTTP data:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+HTTPREAD: .*|%s)$`,
+		string(ErrorResponse))), 10*time.Second)
+	if err != nil {
+		return 0, errors.New("could not read HTTP data:" + err.Error())
+	}
+	s := httpReadRegexp.FindStringSubmatch(m)
+	if s == nil {
+		return 0, errors.New("could not read HTTP data: " + m)
+	}
+	n, _ := strconv.Atoi(s[1])
+	data, err := g.readBytes(n, 10*time.Second)
+	if err != nil {
+		return 0, errors.New("could not read HTTP data:" + err.Error())
+	}
+	_, err = g.waitForLine(okRegexp, 5*time.Second)
+	if err != nil {
+		return 0, errors.New("could not read HTTP data:" + err.Error())
+	}
+	if n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b.offset += int64(n)
+	g.accountTraffic(n, 0)
+	return copy(p, data), nil
+}
+
+func (b *nativeHTTPBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.t.release()
+	return nil
+}
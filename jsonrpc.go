@@ -1,22 +1,12 @@
 package gsmtcp
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/oklog/ulid"
-	"github.com/rs/zerolog/log"
-	"io"
-	"io/ioutil"
-	"math/rand"
+	"github.com/bouwerp/gsmtcp/jsonrpc"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"regexp"
-	"strconv"
-	"time"
 )
 
 // ClientRequest represents a JSON-RPC request sent by a client.
@@ -35,143 +25,55 @@ type ClientResponse struct {
 	Id      string           `json:"id"`
 }
 
-func generateULID() string {
-	t := time.Now()
-	entropy := ulid.Monotonic(rand.New(rand.NewSource(t.UnixNano())), 0)
-	return ulid.MustNew(ulid.Timestamp(t), entropy).String()
-}
-
 // EncodeClientRequest encodes parameters for a JSON-RPC client request.
 func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
 	c := ClientRequest{
 		JsonRpc: "2.0",
 		Method:  method,
 		Params:  [1]interface{}{args},
-		Id:      generateULID(),
+		Id:      jsonrpc.NewULID(),
 	}
 	return json.Marshal(c)
 }
 
-// Error represents an arbitrary error value returned by a JSON-RPC request.
-type Error struct {
-	Data interface{}
-}
+// Error represents an error returned by a JSON-RPC request.
+type Error = jsonrpc.Error
 
-func (e *Error) Error() string {
-	return fmt.Sprintf("%v", e.Data)
+// DoRequest executes a JSON-RPC request with the provided param over an established connection, such as a TLS
+// connection. A pointer to the result reply must be given for the response to be unmarshalled. The param is sent as
+// the single by-position parameter. Use jsonrpc.Client for notifications, batches and by-name params.
+func DoRequest(url string, conn net.Conn, method string, param interface{}, reply interface{}) error {
+	return doRequest(url, &Transport{Conn: conn}, method, param, reply, jsonrpc.RetryPolicy{})
 }
 
-// DoRequest executes a JSON-RPC request with the provided param. A pointer to the result reply
-// must be given for the response to be unmarshalled.
-func DoRequest(url string, conn *tls.Conn, method string, param interface{}, reply interface{}) error {
-	c := &http.Client{
-		Transport: Transport{Conn: conn},
-	}
-	request, err := EncodeClientRequest(method, param)
-	if err != nil {
-		log.Error()
-		return err
-	}
-	r, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(request))
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("Accept", "application/json")
-	r.Header.Set("Content-Length", strconv.Itoa(len(request)))
-	r.Header.Add("Accept-Encoding", "identity")
-	resp, err := c.Do(r)
-	if err != nil {
-		log.Error().Err(err)
-		return err
-	}
-	if resp != nil {
-		defer func() {
-			if resp.Body != nil {
-				err := resp.Body.Close()
-				if err != nil {
-					log.Error().Err(err).Msgf("could not close body: %s", err.Error())
-				}
-			}
-		}()
-		if resp.Body != nil {
-			content, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Error().Err(err).Msgf("could not read resp.Body: %s", err.Error())
-				return err
-			}
-			var c ClientResponse
-			if err := json.NewDecoder(bytes.NewReader(content)).Decode(&c); err != nil {
-				return err
-			}
-			if c.Error != nil {
-				return &Error{Data: c.Error}
-			}
-			if c.Result == nil {
-				return fmt.Errorf("unexpected null result")
-			}
-			return json.Unmarshal(*c.Result, reply)
-		}
-	}
-	return nil
+// DoRequestWithRetry executes a JSON-RPC request like DoRequest, retrying it as the policy allows. The connection is
+// opened with the dial function, opened again if it drops, and closed once the request is done. The request's ULID
+// id is sent as its idempotency key, and stays the same across retries, so that the server can tell whether it has
+// already processed the request.
+func DoRequestWithRetry(url string, dial func() (net.Conn, error), method string, param interface{},
+	reply interface{}, policy jsonrpc.RetryPolicy) error {
+	transport := &Transport{Dial: dial}
+	defer transport.CloseIdleConnections()
+	return doRequest(url, transport, method, param, reply, policy)
 }
 
-// Transport is a custom implementation of the Transport interface for utilising an existing TLS connection.
-type Transport struct {
-	Conn net.Conn
-}
-
-func (r Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	reqBytes, err := httputil.DumpRequest(req, true)
-	if err != nil {
-		log.Error().Err(err)
-		return nil, err
-	}
-	_, err = r.Conn.Write(reqBytes)
-	if err != nil {
-		log.Error().Err(err)
-		return nil, err
+func doRequest(url string, transport *Transport, method string, param interface{}, reply interface{},
+	policy jsonrpc.RetryPolicy) error {
+	c := &jsonrpc.Client{
+		URL:        url,
+		HTTPClient: &http.Client{Transport: transport},
+		NewID: func() interface{} {
+			return jsonrpc.NewULID()
+		},
+		Retry: policy,
 	}
-	// read the response
-	scanner := bufio.NewScanner(r.Conn)
-	// custom scanner that returns tokens between EOFs
-	contentLengthRegexp := regexp.MustCompile("Content-Length: (78)")
-	hasContentLength := func(b string) bool {
-		return contentLengthRegexp.MatchString(b)
-	}
-	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
-		if atEOF {
-			return 0, data, io.EOF
-		}
-		if isEndOfChunks(data) {
-			return 0, data, bufio.ErrFinalToken
-		}
-		if hasContentLength(string(data)) {
-			return 0, data, bufio.ErrFinalToken
-		}
-		return len(data), data, nil
-	})
-	// if data is available
-	var data []byte
-	for scanner.Scan() {
-		data = append(data, scanner.Bytes()...)
-	}
-	reader := bufio.NewReader(bytes.NewReader(data))
-	var resp *http.Response
-	resp, err = http.ReadResponse(reader, req)
+	var result json.RawMessage
+	err := c.Call(context.Background(), method, [1]interface{}{param}, &result)
 	if err != nil {
-		log.Error().Err(err).Msgf("could not read response body: %s", err.Error())
-		return nil, err
+		return err
 	}
-	return resp, nil
-}
-
-func isEndOfChunks(chunk []byte) bool {
-	eoc := []byte{13, 10, 48, 13, 10, 13, 10}
-	if len(chunk) == len(eoc) {
-		for i, b := range chunk {
-			if b != eoc[i] {
-				return false
-			}
-		}
-		return true
+	if len(result) == 0 || string(result) == "null" {
+		return fmt.Errorf("unexpected null result")
 	}
-	return false
+	return json.Unmarshal(result, reply)
 }
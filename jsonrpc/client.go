@@ -0,0 +1,340 @@
+// Package jsonrpc implements a JSON-RPC 2.0 client over HTTP. It supports by-position and by-name params, numeric and
+// string ids, notifications, and batches, which send several calls in a single HTTP round trip to save latency on
+// GPRS links. The HTTP client can use any transport, such as gsmtcp.Transport over a connection made through a GSM
+// module.
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Version is the JSON-RPC version implemented by the package.
+const Version = "2.0"
+
+// Request is a JSON-RPC request object. A request without an id is a notification.
+type Request struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      interface{} `json:"id,omitempty"`
+}
+
+// Response is a JSON-RPC response object, as decoded by the client.
+type Response struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+	ID      interface{} `json:"id"`
+}
+
+// Call is a single call in a batch. After the batch has been sent, Error holds the outcome of the call.
+type Call struct {
+	Method string
+	// Params are the parameters of the call: a slice or array for by-position params, a struct or map for by-name
+	// params, or nil.
+	Params interface{}
+	// Result is a pointer to the value into which the result is unmarshalled. It may be nil to discard the result.
+	Result interface{}
+	// Notification marks a call to which the server does not respond.
+	Notification bool
+	Error        error
+
+	id string
+}
+
+// Client calls methods on a JSON-RPC server over HTTP.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+	// NewID generates the id of each call, which must be a string or a number. It defaults to sequential numbers.
+	NewID func() interface{}
+	// Codec encodes requests and decodes responses. It defaults to JSON.
+	Codec Codec
+	// Compression configures the compression of request bodies.
+	Compression Compression
+	// Retry configures the retries of failed requests. By default requests are not retried.
+	Retry RetryPolicy
+
+	mu          sync.Mutex
+	nextID      uint64
+	stats       CompressionStats
+	compressors compressors
+}
+
+// NewClient creates a client for the server at the URL. If httpClient is nil, http.DefaultClient is used.
+func NewClient(url string, httpClient *http.Client) *Client {
+	return &Client{URL: url, HTTPClient: httpClient}
+}
+
+// NewULID returns a new ULID, which can be used as a string id that sorts by time.
+func NewULID() string {
+	t := time.Now()
+	entropy := ulid.Monotonic(rand.New(rand.NewSource(t.UnixNano())), 0)
+	return ulid.MustNew(ulid.Timestamp(t), entropy).String()
+}
+
+func (c *Client) newID() interface{} {
+	if c.NewID != nil {
+		return c.NewID()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return c.nextID
+}
+
+// Call calls a method, unmarshalling its result into the value pointed to by result.
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	call := &Call{Method: method, Params: params, Result: result}
+	err := c.send(ctx, []*Call{call}, false)
+	if err != nil {
+		return err
+	}
+	return call.Error
+}
+
+// Notify sends a notification, to which the server does not respond.
+func (c *Client) Notify(ctx context.Context, method string, params interface{}) error {
+	return c.send(ctx, []*Call{{Method: method, Params: params, Notification: true}}, false)
+}
+
+// CallBatch sends the calls as a single batch. The returned error reports failures of the batch as a whole; the
+// outcome of each call is set in its Error field.
+func (c *Client) CallBatch(ctx context.Context, calls ...*Call) error {
+	if len(calls) == 0 {
+		return errors.New("empty batch")
+	}
+	return c.send(ctx, calls, true)
+}
+
+// checkParams verifies that the params are structured, as the specification requires.
+func checkParams(params interface{}) (interface{}, error) {
+	if params == nil {
+		return nil, nil
+	}
+	v := reflect.ValueOf(params)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return params, nil
+	}
+	return nil, errors.New("params must be an array or an object")
+}
+
+func (c *Client) codec() Codec {
+	if c.Codec == nil {
+		return JSON
+	}
+	return c.Codec
+}
+
+func (c *Client) send(ctx context.Context, calls []*Call, batch bool) error {
+	requests := make([]Request, len(calls))
+	pending := make(map[string]*Call)
+	for i, call := range calls {
+		params, err := checkParams(call.Params)
+		if err != nil {
+			return fmt.Errorf("could not encode params of %s: %v", call.Method, err)
+		}
+		requests[i] = Request{JSONRPC: Version, Method: call.Method, Params: params}
+		if call.Notification {
+			continue
+		}
+		id := c.newID()
+		call.id = idKey(id)
+		requests[i].ID = id
+		pending[call.id] = call
+	}
+	var payload interface{} = requests
+	if !batch {
+		payload = requests[0]
+	}
+	body, err := c.codec().Marshal(payload)
+	if err != nil {
+		return err
+	}
+	key := idempotencyKey(requests, batch)
+	for attempt := 1; ; attempt++ {
+		err = c.exchange(ctx, body, key, pending)
+		failure := err
+		if failure == nil && !batch && len(pending) > 0 {
+			failure = calls[0].Error
+		}
+		if failure == nil || attempt >= c.Retry.MaxAttempts || !c.Retry.retryable(failure) {
+			return err
+		}
+		delay := c.Retry.backoff(attempt - 1)
+		log.Debug().Err(failure).Msgf("jsonrpc: retrying request %s in %v", key, delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		for _, call := range pending {
+			call.Error = nil
+		}
+	}
+}
+
+// exchange posts a request body and matches the responses to the pending calls.
+func (c *Client) exchange(ctx context.Context, body []byte, key string, pending map[string]*Call) error {
+	content, err := c.post(ctx, body, key)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	remaining := make(map[string]*Call, len(pending))
+	for id, call := range pending {
+		remaining[id] = call
+	}
+	return decodeResponses(c.codec(), content, remaining)
+}
+
+// CompressionStats returns the bytes sent and received before and after compression.
+func (c *Client) CompressionStats() CompressionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// compress compresses a request body as configured, returning its content coding, or an empty coding if it is sent
+// as it is.
+func (c *Client) compress(body []byte) ([]byte, string, error) {
+	minSize := c.Compression.MinSize
+	if minSize == 0 {
+		minSize = defaultMinCompressSize
+	}
+	if c.Compression.Encoding == "" || len(body) < minSize {
+		return body, "", nil
+	}
+	compressed, err := c.compressors.compress(c.Compression.Encoding, c.Compression.Dictionary, body)
+	if err != nil {
+		return nil, "", errors.New("could not compress request:" + err.Error())
+	}
+	if len(compressed) >= len(body) {
+		return body, "", nil
+	}
+	return compressed, c.Compression.Encoding, nil
+}
+
+func (c *Client) post(ctx context.Context, body []byte, key string) ([]byte, error) {
+	wire, encoding, err := c.compress(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", c.codec().ContentType())
+	req.Header.Set("Accept", c.codec().ContentType())
+	req.Header.Set("Accept-Encoding", c.Compression.acceptEncoding())
+	req.Header.Set(IdempotencyKeyHeader, key)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		// returned as it is, so that IsTransient recognises a connection lost in the middle of the response
+		return nil, err
+	}
+	wireLength := len(content)
+	content, err = c.compressors.decompress(resp.Header.Get("Content-Encoding"), c.Compression.Dictionary, content)
+	if err != nil {
+		return nil, errors.New("could not decompress response:" + err.Error())
+	}
+	c.mu.Lock()
+	c.stats.RequestBytes += int64(len(body))
+	c.stats.RequestWireBytes += int64(len(wire))
+	c.stats.ResponseBytes += int64(len(content))
+	c.stats.ResponseWireBytes += int64(wireLength)
+	c.mu.Unlock()
+	// error responses are only decoded if they carry a JSON-RPC message
+	if resp.StatusCode/100 != 2 {
+		codec, err := codecForContentType(resp.Header.Get("Content-Type"))
+		if err != nil || codec != c.codec() || len(content) == 0 {
+			return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+	}
+	return content, nil
+}
+
+// decodeResponses matches the responses to the pending calls by id.
+func decodeResponses(codec Codec, content []byte, pending map[string]*Call) error {
+	if len(content) == 0 {
+		return errors.New("empty response")
+	}
+	var decoded interface{}
+	err := unmarshalMessage(codec, content, &decoded)
+	if err != nil {
+		return errors.New("could not decode response:" + err.Error())
+	}
+	values, ok := decoded.([]interface{})
+	if !ok {
+		values = []interface{}{decoded}
+	}
+	for _, value := range values {
+		var response Response
+		err := recodeMessage(codec, value, &response)
+		if err != nil {
+			return errors.New("could not decode response:" + err.Error())
+		}
+		id := idKey(response.ID)
+		if id == "" {
+			// the server could not determine the id, e.g. because the request could not be parsed
+			if response.Error != nil {
+				return response.Error
+			}
+			continue
+		}
+		call, ok := pending[id]
+		if !ok {
+			continue
+		}
+		delete(pending, id)
+		if response.Error != nil {
+			call.Error = response.Error
+			continue
+		}
+		if call.Result != nil && response.Result != nil {
+			err := recode(codec, response.Result, call.Result)
+			if err != nil {
+				call.Error = errors.New("could not decode result:" + err.Error())
+			}
+		}
+	}
+	for _, call := range pending {
+		call.Error = fmt.Errorf("no response to %s", call.Method)
+	}
+	return nil
+}
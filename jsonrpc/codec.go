@@ -0,0 +1,165 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"mime"
+	"reflect"
+)
+
+// Codec encodes the JSON-RPC 2.0 envelope and its params and results. Binary codecs keep the envelope's fields and
+// semantics, and are typically 40-60% smaller than JSON.
+//
+// There is no Protobuf codec: Protobuf needs a message type for every value, while the envelope, params and results
+// of JSON-RPC are schemaless. Applications with Protobuf schemas can implement Codec for their own message types.
+type Codec interface {
+	// ContentType is the media type of encoded messages, used for the Content-Type and Accept headers.
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSON is the standard encoding of JSON-RPC.
+var JSON Codec = jsonCodec{}
+
+// CBOR encodes messages as CBOR (RFC 8949). Struct fields are named by their json tags.
+var CBOR Codec = newCBORCodec()
+
+// MessagePack encodes messages as MessagePack. Struct fields are named by their json tags.
+var MessagePack Codec = msgpackCodec{}
+
+var codecs = []Codec{JSON, CBOR, MessagePack}
+
+// codecForContentType returns the codec of a media type, defaulting to JSON.
+func codecForContentType(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == "application/x-msgpack" {
+		return MessagePack, nil
+	}
+	for _, c := range codecs {
+		if c.ContentType() == mediaType {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported content type: %s", mediaType)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() Codec {
+	enc, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func (c cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.enc.Marshal(v)
+}
+
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.dec.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	e := msgpack.NewEncoder(&buf)
+	e.SetCustomStructTag("json")
+	e.UseCompactInts(true)
+	err := e.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	d := msgpack.NewDecoder(bytes.NewReader(data))
+	d.SetCustomStructTag("json")
+	return d.Decode(v)
+}
+
+// unmarshalMessage decodes a request, reply or response into an interface{}, from which its params or results are
+// encoded again. JSON numbers are kept as json.Number, so that they are not rounded to float64 on the
+// way; the final decode into the target is a plain Unmarshal, giving float64 for numbers in an interface{}.
+func unmarshalMessage(codec Codec, data []byte, v interface{}) error {
+	if codec != JSON {
+		return codec.Unmarshal(data, v)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// recode converts a value decoded into an interface{} to the given target by encoding it again.
+func recode(codec Codec, value interface{}, target interface{}) error {
+	b, err := codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(b, target)
+}
+
+// recodeMessage is recode for intermediate values that are encoded again later, keeping their numbers exact.
+func recodeMessage(codec Codec, value interface{}, target interface{}) error {
+	b, err := codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return unmarshalMessage(codec, b, target)
+}
+
+// idKey returns a key identifying an id across the numeric types that codecs decode it to.
+func idKey(id interface{}) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return "s:" + v
+	case json.Number:
+		return "n:" + v.String()
+	default:
+		return fmt.Sprintf("n:%v", v)
+	}
+}
@@ -0,0 +1,50 @@
+package jsonrpc
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+type numbers struct{}
+
+func (numbers) Exact(args int64, reply *int64) error {
+	*reply = args
+	return nil
+}
+
+func (numbers) Any(args interface{}, reply *interface{}) error {
+	*reply = args
+	return nil
+}
+
+func TestJSONNumbers(t *testing.T) {
+	s := NewServer()
+	err := s.Register(numbers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	c := &Client{URL: server.URL}
+
+	// beyond the precision of float64, so only kept if the params are not rounded on the server
+	var exact int64
+	err = c.Call(context.Background(), "numbers.Exact", []interface{}{int64(9007199254740993)}, &exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exact != 9007199254740993 {
+		t.Errorf("int64 param returned as %d", exact)
+	}
+
+	// numbers decoded into an interface{} result are float64, as with encoding/json
+	var result interface{}
+	err = c.Call(context.Background(), "numbers.Any", []interface{}{42}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result.(float64); !ok || result != float64(42) {
+		t.Errorf("interface{} result is %T %v, want float64 42", result, result)
+	}
+}
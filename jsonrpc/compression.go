@@ -0,0 +1,175 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Content codings supported for request and response bodies.
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+	EncodingZstd    = "zstd"
+)
+
+// defaultMinCompressSize is the body size below which compression rarely pays for its header.
+const defaultMinCompressSize = 256
+
+// Compression configures the compression of request bodies. Responses are decompressed whatever the configuration;
+// the client asks for gzip and deflate, and for zstd if a dictionary is set.
+type Compression struct {
+	// Encoding is the content coding of request bodies: EncodingGzip, EncodingDeflate or EncodingZstd. Empty sends
+	// them uncompressed.
+	Encoding string
+	// MinSize is the body size from which requests are compressed. It defaults to 256 bytes. Bodies that do not
+	// shrink are always sent uncompressed.
+	MinSize int
+	// Dictionary is a zstd dictionary, as trained by `zstd --train` on sample payloads, which is shared with the
+	// server. Small repetitive payloads such as telemetry compress far better with it.
+	Dictionary []byte
+}
+
+// CompressionStats counts the bytes of bodies before and after compression.
+type CompressionStats struct {
+	RequestBytes      int64
+	RequestWireBytes  int64
+	ResponseBytes     int64
+	ResponseWireBytes int64
+}
+
+// BytesSaved returns the number of bytes that compression kept off the link.
+func (s CompressionStats) BytesSaved() int64 {
+	return s.RequestBytes - s.RequestWireBytes + s.ResponseBytes - s.ResponseWireBytes
+}
+
+// errMessageTooLarge is returned when a body decompresses to more than maxMessageSize.
+var errMessageTooLarge = errors.New("jsonrpc: message too large")
+
+// compressors holds the zstd encoder and decoder, which are expensive to create and safe for concurrent use. They
+// are created for the dictionary they were first asked for, and created again if the dictionary changes.
+type compressors struct {
+	mu      sync.Mutex
+	created bool
+	dict    []byte
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *compressors) zstd(dict []byte) (*zstd.Encoder, *zstd.Decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.created && bytes.Equal(c.dict, dict) {
+		return c.encoder, c.decoder, nil
+	}
+	eopts := []zstd.EOption{}
+	dopts := []zstd.DOption{zstd.WithDecoderMaxMemory(maxMessageSize)}
+	if len(dict) > 0 {
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+		dopts = append(dopts, zstd.WithDecoderDicts(dict))
+	}
+	encoder, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoder, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		_ = encoder.Close()
+		return nil, nil, err
+	}
+	// the previous encoder and decoder are not closed, as calls in flight may still be using them
+	c.created = true
+	c.dict = append([]byte(nil), dict...)
+	c.encoder, c.decoder = encoder, decoder
+	return encoder, decoder, nil
+}
+
+// compress encodes a body with the content coding.
+func (c *compressors) compress(encoding string, dict []byte, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case EncodingDeflate:
+		// the deflate content coding is the zlib format
+		w = zlib.NewWriter(&buf)
+	case EncodingZstd:
+		encoder, _, err := c.zstd(dict)
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(body, nil), nil
+	default:
+		return nil, errors.New("unsupported content encoding: " + encoding)
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decodes a body with the content coding given in its Content-Encoding header.
+func (c *compressors) decompress(encoding string, dict []byte, body []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case EncodingGzip, "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+	case EncodingDeflate:
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			// some servers send raw deflate data without the zlib header
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	case EncodingZstd:
+		_, decoder, err := c.zstd(dict)
+		if err != nil {
+			return nil, err
+		}
+		content, err := decoder.DecodeAll(body, nil)
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			return nil, errMessageTooLarge
+		}
+		return content, err
+	default:
+		return nil, errors.New("unsupported content encoding: " + encoding)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	return content, nil
+}
+
+// acceptEncoding lists the content codings that the client decompresses.
+func (c Compression) acceptEncoding() string {
+	if c.Encoding == EncodingZstd || len(c.Dictionary) > 0 {
+		return "zstd, gzip, deflate"
+	}
+	return "gzip, deflate"
+}
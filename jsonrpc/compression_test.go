@@ -0,0 +1,40 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecompressRejectsOversizedBodies(t *testing.T) {
+	var c compressors
+	body := bytes.Repeat([]byte{'a'}, maxMessageSize+1)
+	for _, encoding := range []string{EncodingGzip, EncodingDeflate, EncodingZstd} {
+		compressed, err := c.compress(encoding, nil, body)
+		if err != nil {
+			t.Fatalf("%s: could not compress: %v", encoding, err)
+		}
+		_, err = c.decompress(encoding, nil, compressed)
+		if err != errMessageTooLarge {
+			t.Errorf("%s: expected %v, got %v", encoding, errMessageTooLarge, err)
+		}
+	}
+}
+
+func TestCompressorsFollowDictionaryChanges(t *testing.T) {
+	var c compressors
+	body := []byte(`{"jsonrpc":"2.0","method":"report","params":{"temperature":21.5}}`)
+	for _, dict := range [][]byte{nil, []byte("not a zstd dictionary")} {
+		_, _, err := c.zstd(dict)
+		if dict != nil && err == nil {
+			t.Fatal("expected an invalid dictionary to be rejected")
+		}
+	}
+	compressed, err := c.compress(EncodingZstd, nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := c.decompress(EncodingZstd, nil, compressed)
+	if err != nil || !bytes.Equal(content, body) {
+		t.Fatalf("expected %s, got %s (%v)", body, content, err)
+	}
+}
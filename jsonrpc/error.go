@@ -0,0 +1,134 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+)
+
+// ServerErrorMin and ServerErrorMax bound the codes reserved for implementation-defined server errors.
+const (
+	ServerErrorMin = -32099
+	ServerErrorMax = -32000
+)
+
+// ApplicationError is the code of the errors that methods served by a Server return as plain errors. It lies outside
+// the range reserved by the specification, so such errors are not transient.
+const ApplicationError = 1
+
+// Error is the error object of a JSON-RPC response.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// UnmarshalJSON decodes an error object. Servers that return some other value as the error, such as a string, are
+// also accepted: the value is kept in Data and used as the message.
+func (e *Error) UnmarshalJSON(b []byte) error {
+	type errorObject Error
+	var o errorObject
+	err := json.Unmarshal(b, &o)
+	if err == nil && (o.Code != 0 || o.Message != "") {
+		*e = Error(o)
+		return nil
+	}
+	var data interface{}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return err
+	}
+	*e = Error{Message: fmt.Sprintf("%v", data), Data: data}
+	return nil
+}
+
+func (e *Error) Error() string {
+	if e.Code == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// StatusError is returned when the server answers with an HTTP status other than 2xx and no JSON-RPC response.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected HTTP status: " + e.Status
+}
+
+// errorCode returns the code of a JSON-RPC error.
+func errorCode(err error) (int, bool) {
+	e, ok := err.(*Error)
+	if !ok || e == nil {
+		return 0, false
+	}
+	return e.Code, true
+}
+
+func hasCode(err error, code int) bool {
+	c, ok := errorCode(err)
+	return ok && c == code
+}
+
+// IsParseError reports whether the server could not parse the request.
+func IsParseError(err error) bool {
+	return hasCode(err, ParseError)
+}
+
+// IsInvalidRequest reports whether the server rejected the request object as invalid.
+func IsInvalidRequest(err error) bool {
+	return hasCode(err, InvalidRequest)
+}
+
+// IsMethodNotFound reports whether the method does not exist on the server.
+func IsMethodNotFound(err error) bool {
+	return hasCode(err, MethodNotFound)
+}
+
+// IsInvalidParams reports whether the server rejected the params.
+func IsInvalidParams(err error) bool {
+	return hasCode(err, InvalidParams)
+}
+
+// IsInternalError reports whether the server failed internally.
+func IsInternalError(err error) bool {
+	return hasCode(err, InternalError)
+}
+
+// IsServerError reports whether the error has one of the codes reserved for implementation-defined server errors.
+func IsServerError(err error) bool {
+	c, ok := errorCode(err)
+	return ok && c >= ServerErrorMin && c <= ServerErrorMax
+}
+
+// IsTransient reports whether a failed call may succeed if it is retried: network errors, including a connection
+// lost in the middle of a response, HTTP 5xx and 429 statuses, internal errors and implementation-defined server
+// errors. Other HTTP statuses, undecodable responses, malformed requests, unknown methods, invalid params and
+// application errors are not transient.
+func IsTransient(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *Error:
+		return IsInternalError(err) || IsServerError(err)
+	case *StatusError:
+		return e.StatusCode/100 == 5 || e.StatusCode == http.StatusTooManyRequests
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
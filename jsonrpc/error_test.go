@@ -0,0 +1,64 @@
+package jsonrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"internal error", &Error{Code: InternalError}, true},
+		{"server error", &Error{Code: ServerErrorMax}, true},
+		{"method not found", &Error{Code: MethodNotFound}, false},
+		{"application error", &Error{Code: ApplicationError}, false},
+		{"HTTP 500", &StatusError{StatusCode: 500, Status: "500 Internal Server Error"}, true},
+		{"HTTP 503", &StatusError{StatusCode: 503, Status: "503 Service Unavailable"}, true},
+		{"HTTP 429", &StatusError{StatusCode: 429, Status: "429 Too Many Requests"}, true},
+		{"HTTP 400", &StatusError{StatusCode: 400, Status: "400 Bad Request"}, false},
+		{"HTTP 404", &StatusError{StatusCode: 404, Status: "404 Not Found"}, false},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("refused")}, true},
+		{"truncated response", io.ErrUnexpectedEOF, true},
+		{"decode failure", errors.New("could not decode response: invalid character"), false},
+	} {
+		if transient := IsTransient(test.err); transient != test.transient {
+			t.Errorf("%s: IsTransient = %t, want %t", test.name, transient, test.transient)
+		}
+	}
+}
+
+func TestClientRetriesOnlyTransientStatuses(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		attempts int32
+	}{
+		{http.StatusServiceUnavailable, 3},
+		{http.StatusNotFound, 1},
+	} {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(test.status)
+		}))
+		c := &Client{URL: server.URL, Retry: RetryPolicy{MaxAttempts: 3, MinDelay: time.Millisecond}}
+		err := c.Call(context.Background(), "Device.Report", nil, nil)
+		if e, ok := err.(*StatusError); !ok || e.StatusCode != test.status {
+			t.Errorf("HTTP %d: got %v, want a StatusError", test.status, err)
+		}
+		if n := atomic.LoadInt32(&attempts); n != test.attempts {
+			t.Errorf("HTTP %d: sent %d times, want %d", test.status, n, test.attempts)
+		}
+		server.Close()
+	}
+}
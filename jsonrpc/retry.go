@@ -0,0 +1,71 @@
+package jsonrpc
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// IdempotencyKeyHeader is the HTTP header that carries the idempotency key of a request. The key stays the same
+// across retries, so that the server can recognise a request that it has already processed.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy configures how a Client retries failed requests. A request is repeated with the same ids and the same
+// idempotency key, as the server may have processed it even though the response was lost.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, including the first. Zero or one disables retries.
+	MaxAttempts int
+	// MinDelay is the delay before the first retry. It defaults to 1 second.
+	MinDelay time.Duration
+	// MaxDelay caps the delay between retries. It defaults to 30 seconds.
+	MaxDelay time.Duration
+	// Multiplier is the factor by which the delay grows after each retry. It defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, by which each delay is randomly shortened.
+	Jitter float64
+	// Retryable reports whether a failed request should be retried. It defaults to IsTransient. It is given the
+	// failure of a batch as a whole, or the error of a single call. A batch is retried only if it fails as a whole:
+	// the errors of the individual calls in its response are returned as they are, even if they are transient, and
+	// the caller must send the failed calls again itself.
+	Retryable func(err error) bool
+}
+
+// retryable reports whether the error should be retried under the policy.
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return IsTransient(err)
+	}
+	return p.Retryable(err)
+}
+
+// backoff returns the delay before the given retry, counting from zero.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	minDelay := p.MinDelay
+	if minDelay == 0 {
+		minDelay = time.Second
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = 30 * time.Second
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(minDelay) * math.Pow(multiplier, float64(retry))
+	if delay > float64(maxDelay) {
+		delay = float64(maxDelay)
+	}
+	jitter := math.Max(0, math.Min(1, p.Jitter))
+	delay -= delay * jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// idempotencyKey returns the key of a request: the id of a single call, or a new ULID for a batch or notification.
+func idempotencyKey(requests []Request, batch bool) string {
+	if !batch && requests[0].ID != nil {
+		return fmt.Sprintf("%v", requests[0].ID)
+	}
+	return NewULID()
+}
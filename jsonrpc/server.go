@@ -0,0 +1,359 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// maxMessageSize limits the size of a request read by the server, and of a decompressed body.
+const maxMessageSize = 1 << 20
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+type method struct {
+	fn        reflect.Value
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+// Server serves JSON-RPC 2.0 requests for the methods of registered receivers, in the manner of net/rpc. It serves
+// HTTP as an http.Handler, and newline-delimited requests on raw streams with ServeConn.
+type Server struct {
+	// Dictionary is the zstd dictionary used to decompress request bodies, which must match the clients'.
+	Dictionary []byte
+
+	mu          sync.RWMutex
+	methods     map[string]*method
+	compressors compressors
+}
+
+// NewServer creates a server without any registered methods.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]*method)}
+}
+
+// Register publishes the methods of the receiver under the name of its type, as "Type.Method". Methods are
+// registered if they are exported and have the form
+//
+//	func (t *T) MethodName(args A, reply *R) error
+//
+// The params of a call are decoded into args: by-name params into a struct or map, and by-position params into a
+// slice or, if there is a single param, into any type. A method that fails with an *Error sends it as it is; other
+// errors are sent with the code ApplicationError, so clients do not retry them. To have a failure retried, return
+// an *Error with a code between ServerErrorMin and ServerErrorMax.
+func (s *Server) Register(rcvr interface{}) error {
+	name := reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+	return s.RegisterName(name, rcvr)
+}
+
+// RegisterName publishes the methods of the receiver under the given name.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("jsonrpc: no service name for type " + reflect.TypeOf(rcvr).String())
+	}
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+	registered := 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		mt := m.Type
+		if m.PkgPath != "" || mt.NumIn() != 3 || mt.NumOut() != 1 || mt.Out(0) != typeOfError {
+			continue
+		}
+		if mt.In(2).Kind() != reflect.Ptr {
+			continue
+		}
+		s.methods[name+"."+m.Name] = &method{
+			fn:        v.Method(i),
+			argType:   mt.In(1),
+			replyType: mt.In(2).Elem(),
+		}
+		registered++
+	}
+	if registered == 0 {
+		return errors.New("jsonrpc: type " + t.String() + " has no suitable methods")
+	}
+	return nil
+}
+
+// resultResponse and errorResponse are the responses sent by the server. Unlike Response, a successful response always
+// has a result, even if it is null.
+type resultResponse struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result"`
+	ID      interface{} `json:"id"`
+}
+
+type errorResponse struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Error   *Error      `json:"error"`
+	ID      interface{} `json:"id"`
+}
+
+func newErrorResponse(id interface{}, err *Error) errorResponse {
+	return errorResponse{JSONRPC: Version, Error: err, ID: id}
+}
+
+// Handle processes a JSON-encoded request or batch, returning the encoded response, or nil if there is nothing to
+// respond, as for notifications.
+func (s *Server) Handle(message []byte) []byte {
+	return s.handle(JSON, message)
+}
+
+func (s *Server) handle(codec Codec, message []byte) []byte {
+	var decoded interface{}
+	err := unmarshalMessage(codec, message, &decoded)
+	if err != nil {
+		return encodeResponse(codec, newErrorResponse(nil, &Error{Code: ParseError, Message: "Parse error"}))
+	}
+	batch, ok := decoded.([]interface{})
+	if !ok {
+		response := s.handleRequest(codec, decoded)
+		if response == nil {
+			return nil
+		}
+		return encodeResponse(codec, response)
+	}
+	if len(batch) == 0 {
+		return encodeResponse(codec, newErrorResponse(nil, &Error{Code: InvalidRequest, Message: "Invalid Request"}))
+	}
+	var responses []interface{}
+	for _, value := range batch {
+		response := s.handleRequest(codec, value)
+		if response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return encodeResponse(codec, responses)
+}
+
+func encodeResponse(codec Codec, response interface{}) []byte {
+	b, err := codec.Marshal(response)
+	if err != nil {
+		log.Error().Err(err).Msg("jsonrpc: could not encode response")
+		b, _ = codec.Marshal(newErrorResponse(nil, &Error{Code: InternalError, Message: "Internal error"}))
+	}
+	return b
+}
+
+// handleRequest processes a decoded request. An absent id marks a notification, whereas a null id is answered.
+func (s *Server) handleRequest(codec Codec, value interface{}) interface{} {
+	req, ok := value.(map[string]interface{})
+	if !ok {
+		return newErrorResponse(nil, &Error{Code: InvalidRequest, Message: "Invalid Request"})
+	}
+	id, hasID := req["id"]
+	version, _ := req["jsonrpc"].(string)
+	name, _ := req["method"].(string)
+	if version != Version || name == "" {
+		return newErrorResponse(id, &Error{Code: InvalidRequest, Message: "Invalid Request"})
+	}
+	result, rpcErr := s.call(codec, name, req["params"])
+	if !hasID {
+		// notifications are not answered, even when they fail
+		return nil
+	}
+	if rpcErr != nil {
+		return newErrorResponse(id, rpcErr)
+	}
+	return resultResponse{JSONRPC: Version, Result: result, ID: id}
+}
+
+// call invokes a method with the decoded params.
+func (s *Server) call(codec Codec, name string, params interface{}) (result interface{}, rpcErr *Error) {
+	s.mu.RLock()
+	m, ok := s.methods[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, &Error{Code: MethodNotFound, Message: "Method not found"}
+	}
+	arg, err := decodeArg(codec, m.argType, params)
+	if err != nil {
+		return nil, &Error{Code: InvalidParams, Message: "Invalid params", Data: err.Error()}
+	}
+	reply := reflect.New(m.replyType)
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("jsonrpc: method %s panicked: %v", name, r)
+			result = nil
+			rpcErr = &Error{Code: InternalError, Message: "Internal error"}
+		}
+	}()
+	out := m.fn.Call([]reflect.Value{arg, reply})
+	if errValue := out[0].Interface(); errValue != nil {
+		if e, ok := errValue.(*Error); ok {
+			return nil, e
+		}
+		return nil, &Error{Code: ApplicationError, Message: errValue.(error).Error()}
+	}
+	// the reply is encoded here so that a reply that cannot be encoded fails this call only
+	err = recodeMessage(codec, reply.Interface(), &result)
+	if err != nil {
+		return nil, &Error{Code: InternalError, Message: "Internal error", Data: err.Error()}
+	}
+	return result, nil
+}
+
+// decodeArg decodes the params into a new value of the method's argument type.
+func decodeArg(codec Codec, argType reflect.Type, params interface{}) (reflect.Value, error) {
+	isPtr := argType.Kind() == reflect.Ptr
+	elemType := argType
+	if isPtr {
+		elemType = argType.Elem()
+	}
+	arg := reflect.New(elemType)
+	if params != nil {
+		err := decodeParams(codec, arg.Interface(), elemType, params)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	if isPtr {
+		return arg, nil
+	}
+	return arg.Elem(), nil
+}
+
+func decodeParams(codec Codec, arg interface{}, elemType reflect.Type, params interface{}) error {
+	switch p := params.(type) {
+	case map[string]interface{}:
+		return recode(codec, p, arg)
+	case []interface{}:
+		kind := elemType.Kind()
+		if kind == reflect.Slice || kind == reflect.Array {
+			err := recode(codec, p, arg)
+			if err == nil {
+				return nil
+			}
+		}
+		// a single by-position param holds the argument
+		if len(p) != 1 {
+			return fmt.Errorf("expected 1 param, received %d", len(p))
+		}
+		return recode(codec, p[0], arg)
+	default:
+		return errors.New("params must be an array or an object")
+	}
+}
+
+// ServeHTTP serves JSON-RPC requests sent by HTTP POST. Requests are decoded with the codec given by their
+// Content-Type, JSON if there is none, and answered with the same codec.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, "could not read request", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxMessageSize {
+		http.Error(w, errRequestTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err = s.compressors.decompress(r.Header.Get("Content-Encoding"), s.Dictionary, body)
+	if err == errMessageTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	codec, err := codecForContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	response := s.handle(codec, body)
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	_, err = w.Write(response)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not write JSON-RPC response")
+	}
+}
+
+// ServeConn serves requests on a raw stream, with each request or batch and each response on a line of its own. It
+// returns when the stream fails or is closed, and closes it.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := readMessage(r)
+		if err == errRequestTooLarge {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			response := s.Handle(line)
+			if response != nil {
+				_, werr := conn.Write(append(response, '\n'))
+				if werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errRequestTooLarge = errors.New("jsonrpc: request too large")
+
+// readMessage reads the next line, failing as soon as it exceeds maxMessageSize rather than buffering it in full.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxMessageSize+1 {
+			return nil, errRequestTooLarge
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Serve accepts connections on the listener and serves newline-delimited requests on each, until Accept fails. To
+// serve HTTP instead, pass the server to http.Serve.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := s.ServeConn(conn)
+			if err != nil {
+				log.Debug().Err(err).Msg("JSON-RPC connection failed")
+			}
+		}()
+	}
+}
@@ -0,0 +1,197 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keepAliveProbes is the number of unanswered probes after which the module drops the connection, as on Linux.
+const keepAliveProbes = 9
+
+// defaultKeepAlivePeriod is used when keepalive is enabled without a period. It is well below the idle timeout of
+// around 5 minutes that carrier NATs apply.
+const defaultKeepAlivePeriod = 2 * time.Minute
+
+const minKeepAlivePeriod = 30 * time.Second
+const maxKeepAlivePeriod = 2 * time.Hour
+const maxKeepAliveInterval = 10 * time.Minute
+
+// SetTCPKeepAlive configures the module to send TCP keepalive probes (AT+CIPTKA) after the connection has been idle
+// for the given time, and then at the same interval, up to 10 minutes, until the peer answers. Zero disables
+// keepalive.
+func (g *DefaultGsmModule) SetTCPKeepAlive(idle time.Duration) error {
+	mode := 0
+	idleSeconds := int(maxKeepAlivePeriod / time.Second)
+	intervalSeconds := 75
+	if idle != 0 {
+		if idle < minKeepAlivePeriod || idle > maxKeepAlivePeriod {
+			return errors.New("keepalive period must be between 30s and 2h")
+		}
+		mode = 1
+		idleSeconds = int(idle / time.Second)
+		intervalSeconds = idleSeconds
+		if idle > maxKeepAliveInterval {
+			intervalSeconds = int(maxKeepAliveInterval / time.Second)
+		}
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(TCPKeepAliveCommand), mode, idleSeconds, intervalSeconds,
+		keepAliveProbes))
+	if err != nil {
+		if strings.Contains(err.Error(), string(ErrorResponse)) {
+			g.noTCPKeepAlive = true
+		}
+		return errors.New("could not set TCP keepalive:" + err.Error())
+	}
+	g.keepAlive = idle
+	return nil
+}
+
+// keepAliveState holds the keepalive settings of a connection, and serialises its writes with the heartbeat.
+type keepAliveState struct {
+	mu        sync.Mutex
+	enabled   bool
+	period    time.Duration
+	heartbeat func(w io.Writer) error
+	// fallback is set when the connection cannot use TCP keepalive, so that keepalive relies on the heartbeat
+	fallback  bool
+	lastWrite time.Time
+	stop      chan struct{}
+
+	writing sync.Mutex
+}
+
+func (k *keepAliveState) touch() {
+	k.mu.Lock()
+	k.lastWrite = time.Now()
+	k.mu.Unlock()
+}
+
+// stopHeartbeat stops the heartbeat, if running. The caller must hold k.mu.
+func (k *keepAliveState) stopHeartbeat() {
+	if k.stop != nil {
+		close(k.stop)
+		k.stop = nil
+	}
+}
+
+// SetKeepAlive enables or disables keepalive on the connection, in the manner of *net.TCPConn. The module's TCP
+// keepalive is used where available; otherwise the heartbeat set with SetHeartbeat is sent when the connection is
+// idle. As the module has a single TCP stack, the setting also applies to later connections.
+func (c Conn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive.mu.Lock()
+	defer c.keepAlive.mu.Unlock()
+	c.keepAlive.enabled = keepalive
+	return c.applyKeepAlive()
+}
+
+// SetKeepAlivePeriod sets the idle time after which keepalive probes or heartbeats are sent.
+func (c Conn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlive.mu.Lock()
+	defer c.keepAlive.mu.Unlock()
+	c.keepAlive.period = d
+	if !c.keepAlive.enabled {
+		return nil
+	}
+	return c.applyKeepAlive()
+}
+
+// SetHeartbeat sets the application-level heartbeat that keeps the connection alive on modules without TCP
+// keepalive (AT+CIPTKA), and on the module-native TLS stacks. The heartbeat is called with a writer for the
+// connection whenever nothing has been written for the keepalive period, and must write a message that the peer
+// ignores or answers. It takes effect at once if keepalive is enabled on a connection without TCP keepalive, such
+// as one opened with the TCPKeepAlive config on a module without AT+CIPTKA, and otherwise when keepalive is next
+// enabled.
+func (c Conn) SetHeartbeat(beat func(w io.Writer) error) {
+	c.keepAlive.mu.Lock()
+	defer c.keepAlive.mu.Unlock()
+	c.keepAlive.heartbeat = beat
+	if c.keepAlive.enabled && c.keepAlive.fallback {
+		err := c.applyKeepAlive()
+		if err != nil {
+			log.Debug().Err(err).Msg("could not start heartbeat")
+		}
+	}
+}
+
+// applyKeepAlive configures the module or heartbeat for the current settings. The caller must hold keepAlive.mu.
+func (c Conn) applyKeepAlive() error {
+	k := c.keepAlive
+	k.stopHeartbeat()
+	if !k.enabled {
+		if c.secure == nil && c.g.keepAlive != 0 {
+			c.g.mu.Lock()
+			defer c.g.mu.Unlock()
+			return c.g.SetTCPKeepAlive(0)
+		}
+		return nil
+	}
+	period := k.period
+	if period <= 0 {
+		period = defaultKeepAlivePeriod
+	}
+	err := errors.New("TCP keepalive is not supported on module-native TLS connections")
+	if c.secure == nil && k.fallback {
+		err = errors.New("the module does not support TCP keepalive")
+	} else if c.secure == nil {
+		idle := period
+		if idle < minKeepAlivePeriod {
+			idle = minKeepAlivePeriod
+		}
+		c.g.mu.Lock()
+		err = c.g.SetTCPKeepAlive(idle)
+		k.fallback = c.g.noTCPKeepAlive
+		c.g.mu.Unlock()
+		if err == nil {
+			return nil
+		}
+	}
+	if k.heartbeat == nil {
+		return err
+	}
+	log.Debug().Err(err).Msg("falling back to heartbeat")
+	k.stop = make(chan struct{})
+	go c.runHeartbeat(period, k.heartbeat, k.stop)
+	return nil
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// runHeartbeat calls the heartbeat whenever nothing has been written to the connection for the period.
+func (c Conn) runHeartbeat(period time.Duration, beat func(w io.Writer) error, stop chan struct{}) {
+	check := period / 4
+	if check < time.Second {
+		check = time.Second
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.keepAlive.mu.Lock()
+			idle := time.Since(c.keepAlive.lastWrite)
+			c.keepAlive.mu.Unlock()
+			if idle < period {
+				continue
+			}
+			c.keepAlive.writing.Lock()
+			err := beat(writerFunc(c.send))
+			c.keepAlive.writing.Unlock()
+			if err != nil {
+				log.Error().Err(err).Msg("could not send heartbeat")
+				return
+			}
+		}
+	}
+}
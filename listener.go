@@ -0,0 +1,221 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var serverOkRegexp = regexp.MustCompile(`^(SERVER OK|SERVER CLOSE|ERROR)$`)
+var remoteIPRegexp = regexp.MustCompile(`^REMOTE IP: ?(.+)$`)
+
+// errListenerClosed is returned by Accept once a listener has been closed.
+var errListenerClosed = errors.New("listener closed")
+
+// singleConn is a connection accepted by a listener that serves one connection at a time. Closing it lets the
+// listener accept the next one.
+type singleConn struct {
+	net.Conn
+	once     sync.Once
+	released chan struct{}
+}
+
+func (c *singleConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		close(c.released)
+	})
+	return err
+}
+
+// Listener accepts incoming TCP connections on the module (AT+CIPSERVER). The module serves one connection at a time,
+// so Accept waits until the previous connection has been closed. Most SIMs are behind carrier-grade NAT and cannot be
+// reached this way; use a ReverseListener for those.
+type Listener struct {
+	g    *DefaultGsmModule
+	port int
+
+	mu     sync.Mutex
+	active chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// Listen starts a TCP server on the module on the given port.
+func Listen(g *DefaultGsmModule, port int) (*Listener, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	err := g.configureReceiveHeader()
+	if err != nil {
+		return nil, err
+	}
+	err = g.executeATCommand(fmt.Sprintf(string(ServerCommand), port))
+	if err != nil {
+		return nil, errors.New("could not start server:" + err.Error())
+	}
+	m, err := g.waitForLine(serverOkRegexp, 5*time.Second)
+	if err != nil {
+		return nil, errors.New("could not start server:" + err.Error())
+	}
+	if m != "SERVER OK" {
+		return nil, errors.New("could not start server: " + m)
+	}
+	return &Listener{g: g, port: port, done: make(chan struct{})}, nil
+}
+
+// Accept waits for the next incoming connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	if active != nil {
+		select {
+		case <-active:
+		case <-l.done:
+			return nil, errListenerClosed
+		}
+	}
+	for {
+		select {
+		case <-l.done:
+			return nil, errListenerClosed
+		default:
+		}
+		var conn *Conn
+		l.g.mu.Lock()
+		m, err := l.g.waitForLine(remoteIPRegexp, time.Second)
+		if err == nil {
+			l.g.resetConnectionState()
+			l.g.connOpen = true
+			conn = newConn(l.g, "tcp", remoteIPRegexp.FindStringSubmatch(m)[1])
+		}
+		l.g.mu.Unlock()
+		if err != nil {
+			if _, ok := err.(TimedOutErr); ok {
+				continue
+			}
+			return nil, err
+		}
+		log.Debug().Msgf("accepted connection from %s", conn.remoteAddress)
+		conn.accountConnection()
+		c := &singleConn{Conn: conn, released: make(chan struct{})}
+		l.mu.Lock()
+		l.active = c.released
+		l.mu.Unlock()
+		return c, nil
+	}
+}
+
+// Close stops the server. A connection that has already been accepted is not closed.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+	l.g.mu.Lock()
+	defer l.g.mu.Unlock()
+	err := l.g.executeATCommand(string(StopServerCommand))
+	if err != nil {
+		return errors.New("could not stop server:" + err.Error())
+	}
+	return nil
+}
+
+// Addr returns the module's IP address and the port listened on.
+func (l *Listener) Addr() net.Addr {
+	l.g.mu.Lock()
+	defer l.g.mu.Unlock()
+	return &net.TCPAddr{IP: l.g.localIP, Port: l.port}
+}
+
+// ReverseListener is a net.Listener for devices behind carrier-grade NAT, which cannot accept incoming connections.
+// Accept dials out to a backend, which then sends its requests over the connection, so that a server such as
+// jsonrpc.Server can run on the device. One connection is open at a time: once it has been closed, the next Accept
+// dials again.
+type ReverseListener struct {
+	// Dial opens the connection to the backend, for example with NewConnection or a Dialer.
+	Dial func() (net.Conn, error)
+	// RetryDelay is the delay after a failed dial. It defaults to 10 seconds.
+	RetryDelay time.Duration
+
+	mu     sync.Mutex
+	active chan struct{}
+	conn   net.Conn
+	done   chan struct{}
+	closed bool
+}
+
+// NewReverseListener creates a listener whose connections are opened with the dial function.
+func NewReverseListener(dial func() (net.Conn, error)) *ReverseListener {
+	return &ReverseListener{Dial: dial, done: make(chan struct{})}
+}
+
+// Accept waits until the previous connection has been closed, then dials the backend, retrying until it succeeds or
+// the listener is closed.
+func (l *ReverseListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	if active != nil {
+		select {
+		case <-active:
+		case <-l.done:
+			return nil, errListenerClosed
+		}
+	}
+	delay := l.RetryDelay
+	if delay == 0 {
+		delay = 10 * time.Second
+	}
+	for {
+		select {
+		case <-l.done:
+			return nil, errListenerClosed
+		default:
+		}
+		conn, err := l.Dial()
+		if err == nil {
+			c := &singleConn{Conn: conn, released: make(chan struct{})}
+			l.mu.Lock()
+			l.active = c.released
+			l.conn = conn
+			l.mu.Unlock()
+			return c, nil
+		}
+		log.Debug().Err(err).Msgf("could not dial backend, retrying in %v", delay)
+		select {
+		case <-l.done:
+			return nil, errListenerClosed
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Close stops the listener. A connection that has already been accepted is not closed.
+func (l *ReverseListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+	return nil
+}
+
+// Addr returns the local address of the current connection.
+func (l *ReverseListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return hostAddr{network: "tcp", address: "reverse"}
+	}
+	return l.conn.LocalAddr()
+}
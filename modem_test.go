@@ -0,0 +1,431 @@
+package gsmtcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeSerialBuffer is the amount of unread data after which the fake modem stops forwarding received data, as a
+// module does when the serial line falls behind.
+const fakeSerialBuffer = 4096
+
+// fakeModuleBuffer is the amount of data the fake modem holds in manual receive mode before it stops reading.
+const fakeModuleBuffer = 64 << 10
+
+var fakeConnectRegexp = regexp.MustCompile(`^AT\+CIPSTART="TCP", "(.*)", "(.*)"$`)
+var fakeSendRegexp = regexp.MustCompile(`^AT\+CIPSEND=([0-9]+)$`)
+var fakeReceiveRegexp = regexp.MustCompile(`^AT\+CIPRXGET=2,([0-9]+)$`)
+var fakeFSWriteRegexp = regexp.MustCompile(`^AT\+FSWRITE=(.*),([01]),([0-9]+),[0-9]+$`)
+var fakeCFSWriteRegexp = regexp.MustCompile(`^AT\+CFSWFILE=3,"(.*)",([01]),([0-9]+),[0-9]+$`)
+var fakeCertDownRegexp = regexp.MustCompile(`^AT\+CCERTDOWN="(.*)",([0-9]+)$`)
+var fakeSecureOpenRegexp = regexp.MustCompile(`^AT\+(CAOPEN=0|CCHOPEN=0),"(.*)",([0-9]+)(,2)?$`)
+var fakeSecureSendRegexp = regexp.MustCompile(`^AT\+(CASEND|CCHSEND)=0,([0-9]+)$`)
+var fakeSecureReceiveRegexp = regexp.MustCompile(`^AT\+(CARECV|CCHRECV)=0,([0-9]+)$`)
+
+// fakeConfigCommands are the configuration commands that the fake modem accepts without acting on them.
+var fakeConfigCommands = []string{"AT+CIPQSEND=", "AT+CIPMODE=", "AT+CIPSSL=", "AT+SSLOPT=", "AT+FSCREATE=",
+	"AT+CFSINIT", "AT+CFSTERM", "AT+CSSLCFG=", "AT+CASSLCFG=", "AT+CCHSET=", "AT+CCHSSLCFG=", "AT+CNACT="}
+
+// Stacks that a connection of the fake modem is open on: the TCP/IP stack, the SIM7000 SSL application stack and
+// the SIM7600 SSL stack.
+const (
+	fakeStackIP  = ""
+	fakeStackCA  = "CA"
+	fakeStackCCH = "CCH"
+)
+
+// fakeModem simulates the TCP/IP stack of a SIM800 module on the other end of the serial line, along with the file
+// systems and SSL stacks of SIM800, SIM7000 and SIM7600 modules. Its connections are real TCP connections, so that
+// it can be tested against local listeners; the SSL stacks pass the data through as it is. Like older firmware, it
+// does not support TCP keepalive (AT+CIPTKA).
+type fakeModem struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// in holds the data written by the host that has not been processed, out the data for the host to read
+	in     []byte
+	out    []byte
+	closed bool
+	// commands records the commands received from the host
+	commands []string
+
+	header  bool
+	manual  bool
+	files   map[string][]byte
+	stack   string
+	conn    net.Conn
+	dropped bool
+	sent    int
+	// held is the data held in manual receive mode, and notified is set once its arrival has been notified
+	held     []byte
+	notified bool
+}
+
+func newFakeModem() *fakeModem {
+	m := &fakeModem{files: make(map[string][]byte)}
+	m.cond = sync.NewCond(&m.mu)
+	go m.run()
+	return m
+}
+
+func (m *fakeModem) Println(str string) error {
+	_, err := m.Write([]byte(str + "\r\n"))
+	return err
+}
+
+func (m *fakeModem) Write(data []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, errors.New("serial port is not open")
+	}
+	m.in = append(m.in, data...)
+	m.cond.Broadcast()
+	return len(data), nil
+}
+
+func (m *fakeModem) Read() (byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.out) == 0 {
+		return 0, io.EOF
+	}
+	b := m.out[0]
+	m.out = m.out[1:]
+	if len(m.out) == fakeSerialBuffer-1 {
+		m.cond.Broadcast()
+	}
+	return b, nil
+}
+
+func (m *fakeModem) WaitForRegexTimeout(exp string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	re := regexp.MustCompile(exp)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		i := bytes.IndexByte(m.out, '\n')
+		var line string
+		if i >= 0 {
+			line = strings.TrimRight(string(m.out[:i]), "\r")
+			m.out = m.out[i+1:]
+		}
+		m.mu.Unlock()
+		if match := re.FindString(line); match != "" {
+			return match, nil
+		}
+		if i < 0 {
+			time.Sleep(serialPollInterval)
+		}
+	}
+	return "", errors.New("Timeout expired")
+}
+
+func (m *fakeModem) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.conn != nil {
+		_ = m.conn.Close()
+	}
+	m.cond.Broadcast()
+	return nil
+}
+
+// emit queues a response for the host. The caller must hold m.mu.
+func (m *fakeModem) emit(s string) {
+	m.out = append(m.out, s...)
+}
+
+// next waits for n bytes, or a line if n is negative, from the host. The caller must hold m.mu.
+func (m *fakeModem) next(n int) ([]byte, bool) {
+	for !m.closed {
+		if n < 0 {
+			if i := bytes.Index(m.in, []byte("\r\n")); i >= 0 {
+				line := m.in[:i]
+				m.in = m.in[i+2:]
+				return line, true
+			}
+		} else if len(m.in) >= n {
+			data := m.in[:n]
+			m.in = m.in[n:]
+			return data, true
+		}
+		m.cond.Wait()
+	}
+	return nil, false
+}
+
+// run processes the commands written by the host.
+func (m *fakeModem) run() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		line, ok := m.next(-1)
+		if !ok {
+			return
+		}
+		m.commands = append(m.commands, string(line))
+		m.execute(string(line))
+	}
+}
+
+// execute carries out a command. The caller must hold m.mu, which is released while connecting and sending.
+func (m *fakeModem) execute(cmd string) {
+	connected := m.conn != nil && !m.dropped
+	switch {
+	case cmd == "AT+CIPHEAD=0" || cmd == "AT+CIPHEAD=1":
+		m.header = cmd == "AT+CIPHEAD=1"
+		m.emit("\r\nOK\r\n")
+	case cmd == "AT+CIPRXGET=0" || cmd == "AT+CIPRXGET=1":
+		m.manual = cmd == "AT+CIPRXGET=1"
+		m.emit("\r\nOK\r\n")
+	case fakeConnectRegexp.MatchString(cmd):
+		if connected {
+			m.emit("\r\nERROR\r\n\r\nALREADY CONNECT\r\n")
+			return
+		}
+		s := fakeConnectRegexp.FindStringSubmatch(cmd)
+		m.emit("\r\nOK\r\n")
+		if !m.connect(s[1], s[2], fakeStackIP) {
+			m.emit("\r\nCONNECT FAIL\r\n")
+			return
+		}
+		m.emit("\r\nCONNECT OK\r\n")
+	case cmd == "AT+CIPSTATUS":
+		state := "TCP CLOSED"
+		if connected {
+			state = "CONNECT OK"
+		}
+		m.emit("\r\nOK\r\n\r\nSTATE: " + state + "\r\n")
+	case cmd == "AT+CIFSR":
+		m.emit("\r\n10.0.0.2\r\n")
+	case cmd == "AT+CIPSEND?":
+		m.emit(fmt.Sprintf("\r\n+CIPSEND: %d\r\n\r\nOK\r\n", maxReceiveLength))
+	case fakeSendRegexp.MatchString(cmd):
+		n, _ := strconv.Atoi(fakeSendRegexp.FindStringSubmatch(cmd)[1])
+		m.emit("\r\n> ")
+		data, ok := m.next(n)
+		if !ok {
+			return
+		}
+		if !connected {
+			m.emit("\r\nERROR\r\n")
+			return
+		}
+		if m.forward(data) != nil {
+			m.emit("\r\nSEND FAIL\r\n")
+			return
+		}
+		m.emit("\r\nSEND OK\r\n")
+	case fakeReceiveRegexp.MatchString(cmd):
+		if !m.manual || (len(m.held) == 0 && !connected) {
+			m.emit("\r\nERROR\r\n")
+			return
+		}
+		n, _ := strconv.Atoi(fakeReceiveRegexp.FindStringSubmatch(cmd)[1])
+		data := m.take(n)
+		m.emit(fmt.Sprintf("\r\n+CIPRXGET: 2,%d,%d\r\n%s\r\nOK\r\n", len(data), len(m.held), data))
+	case cmd == "AT+CIPACK":
+		m.emit(fmt.Sprintf("\r\n+CIPACK: %d,%d,0\r\n\r\nOK\r\n", m.sent, m.sent))
+	case cmd == "AT+CIPCLOSE":
+		if !connected {
+			m.emit("\r\nERROR\r\n")
+			return
+		}
+		_ = m.conn.Close()
+		m.conn = nil
+		m.emit("\r\nCLOSE OK\r\n")
+	case fakeFSWriteRegexp.MatchString(cmd):
+		s := fakeFSWriteRegexp.FindStringSubmatch(cmd)
+		m.emit("\r\n> ")
+		m.writeFile(s[1], s[2] == "1", s[3])
+	case fakeCFSWriteRegexp.MatchString(cmd):
+		s := fakeCFSWriteRegexp.FindStringSubmatch(cmd)
+		m.emit("\r\nDOWNLOAD\r\n")
+		m.writeFile(s[1], s[2] == "1", s[3])
+	case fakeCertDownRegexp.MatchString(cmd):
+		s := fakeCertDownRegexp.FindStringSubmatch(cmd)
+		m.emit("\r\n>")
+		m.writeFile(s[1], false, s[2])
+	case strings.HasPrefix(cmd, "AT+SSLSETCERT="):
+		m.emit("\r\nOK\r\n\r\n+SSLSETCERT: 0\r\n")
+	case cmd == "AT+CNACT?":
+		m.emit("\r\n+CNACT: 1,\"10.0.0.2\"\r\n\r\nOK\r\n")
+	case cmd == "AT+CCHSTART" || cmd == "AT+CCHSTOP":
+		m.emit(fmt.Sprintf("\r\nOK\r\n\r\n+%s: 0\r\n", cmd[3:]))
+	case fakeSecureOpenRegexp.MatchString(cmd):
+		s := fakeSecureOpenRegexp.FindStringSubmatch(cmd)
+		stack, result := fakeStackCA, 0
+		if s[1] == "CCHOPEN=0" {
+			stack = fakeStackCCH
+		}
+		if connected || !m.connect(s[2], s[3], stack) {
+			result = 1
+		}
+		if stack == fakeStackCA {
+			m.emit(fmt.Sprintf("\r\n+CAOPEN: 0,%d\r\n\r\nOK\r\n", result))
+		} else {
+			m.emit(fmt.Sprintf("\r\nOK\r\n\r\n+CCHOPEN: 0,%d\r\n", result))
+		}
+	case fakeSecureSendRegexp.MatchString(cmd):
+		n, _ := strconv.Atoi(fakeSecureSendRegexp.FindStringSubmatch(cmd)[2])
+		m.emit("\r\n>")
+		data, ok := m.next(n)
+		if !ok {
+			return
+		}
+		if !connected || m.forward(data) != nil {
+			m.emit("\r\nERROR\r\n")
+			return
+		}
+		m.emit("\r\nOK\r\n")
+	case fakeSecureReceiveRegexp.MatchString(cmd):
+		s := fakeSecureReceiveRegexp.FindStringSubmatch(cmd)
+		n, _ := strconv.Atoi(s[2])
+		data := m.take(n)
+		if s[1] == "CARECV" {
+			m.emit(fmt.Sprintf("\r\n+CARECV: %d,%s\r\n\r\nOK\r\n", len(data), data))
+		} else if len(data) > 0 {
+			m.emit(fmt.Sprintf("\r\nOK\r\n\r\n+CCHRECV: DATA,0,%d\r\n%s\r\n+CCHRECV: 0,0\r\n", len(data), data))
+		} else {
+			m.emit("\r\nOK\r\n\r\n+CCHRECV: 0,0\r\n")
+		}
+	case cmd == "AT+CACLOSE=0" || cmd == "AT+CCHCLOSE=0":
+		if !connected {
+			m.emit("\r\nERROR\r\n")
+			return
+		}
+		_ = m.conn.Close()
+		m.conn = nil
+		if cmd == "AT+CACLOSE=0" {
+			m.emit("\r\nOK\r\n")
+		} else {
+			m.emit("\r\nOK\r\n\r\n+CCHCLOSE: 0,0\r\n")
+		}
+	default:
+		for _, prefix := range fakeConfigCommands {
+			if strings.HasPrefix(cmd, prefix) {
+				m.emit("\r\nOK\r\n")
+				return
+			}
+		}
+		m.emit("\r\nERROR\r\n")
+	}
+}
+
+// connect opens a connection to the host on the given stack, releasing m.mu while dialling. The caller must hold
+// m.mu.
+func (m *fakeModem) connect(host, port, stack string) bool {
+	m.mu.Unlock()
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	m.mu.Lock()
+	if err != nil {
+		return false
+	}
+	m.conn, m.stack, m.dropped, m.sent, m.held, m.notified = conn, stack, false, 0, nil, false
+	go m.receive(conn)
+	return true
+}
+
+// forward writes data to the connection, releasing m.mu meanwhile. The caller must hold m.mu.
+func (m *fakeModem) forward(data []byte) error {
+	conn := m.conn
+	m.mu.Unlock()
+	_, err := conn.Write(data)
+	m.mu.Lock()
+	if err == nil {
+		m.sent += len(data)
+	}
+	return err
+}
+
+// take returns up to n bytes of the data held in manual receive mode. The caller must hold m.mu.
+func (m *fakeModem) take(n int) []byte {
+	if n > len(m.held) {
+		n = len(m.held)
+	}
+	data := m.held[:n]
+	m.held = m.held[n:]
+	if len(m.held) == 0 {
+		m.notified = false
+	}
+	m.cond.Broadcast()
+	return data
+}
+
+// writeFile stores the given number of bytes from the host in a file, appending to it or replacing it. The caller
+// must hold m.mu.
+func (m *fakeModem) writeFile(name string, appending bool, length string) {
+	n, _ := strconv.Atoi(length)
+	data, ok := m.next(n)
+	if !ok {
+		return
+	}
+	if appending {
+		data = append(m.files[name], data...)
+	}
+	m.files[name] = append([]byte(nil), data...)
+	m.emit("\r\nOK\r\n")
+}
+
+// receive forwards the data received on the connection to the host, and reports when the peer closes it.
+func (m *fakeModem) receive(conn net.Conn) {
+	buf := make([]byte, maxReceiveLength)
+	for {
+		n, err := conn.Read(buf)
+		m.mu.Lock()
+		if m.conn != conn {
+			// closed by the host
+			m.mu.Unlock()
+			return
+		}
+		if n > 0 {
+			if m.manual || m.stack != fakeStackIP {
+				for len(m.held) >= fakeModuleBuffer && m.conn == conn && !m.closed {
+					m.cond.Wait()
+				}
+				if m.conn != conn {
+					m.mu.Unlock()
+					return
+				}
+				m.held = append(m.held, buf[:n]...)
+				if !m.notified {
+					m.notified = true
+					m.emit(map[string]string{
+						fakeStackIP:  "\r\n+CIPRXGET: 1\r\n",
+						fakeStackCA:  "\r\n+CADATAIND: 0\r\n",
+						fakeStackCCH: "\r\n+CCHEVENT: 0,RECV EVENT\r\n",
+					}[m.stack])
+				}
+			} else {
+				for len(m.out) >= fakeSerialBuffer && m.conn == conn && !m.closed {
+					m.cond.Wait()
+				}
+				if m.conn != conn {
+					m.mu.Unlock()
+					return
+				}
+				m.emit(fmt.Sprintf("\r\n+IPD,%d:", n))
+				m.out = append(m.out, buf[:n]...)
+			}
+		}
+		if err != nil {
+			m.dropped = true
+			m.emit(map[string]string{
+				fakeStackIP:  "\r\nCLOSED\r\n",
+				fakeStackCA:  "\r\n+CASTATE: 0,0\r\n",
+				fakeStackCCH: "\r\n+CCH_PEER_CLOSED: 0\r\n",
+			}[m.stack])
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
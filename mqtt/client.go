@@ -0,0 +1,794 @@
+// Package mqtt implements an MQTT 3.1.1 client for connections established through a GSM module. The client does not
+// depend on read deadlines, and its keepalive defaults are tuned for the latency and NAT timeouts of cellular links.
+//
+// The network connection is opened by a dial function, typically gsmtcp.NewConnection, optionally wrapped in TLS:
+//
+//	client := mqtt.NewClient(mqtt.Options{
+//		ClientID: "device-1",
+//		Dial: func() (net.Conn, error) {
+//			conn, err := gsmtcp.NewConnection(g, "<IPv4>:8883")
+//			if err != nil {
+//				return nil, err
+//			}
+//			return tls.Client(conn, tlsConfig), nil
+//		},
+//		AutoReconnect: true,
+//	})
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QoS is the quality of service level of a message.
+type QoS byte
+
+const AtMostOnce QoS = 0
+const AtLeastOnce QoS = 1
+const ExactlyOnce QoS = 2
+
+// Message is an application message published to or received from the server.
+type Message struct {
+	Topic     string
+	Payload   []byte
+	QoS       QoS
+	Retained  bool
+	Duplicate bool
+	ID        uint16
+}
+
+// MessageHandler processes messages received on a subscription. Handlers are called one at a time, in the order
+// the messages were received.
+type MessageHandler func(m *Message)
+
+// Options configures a Client.
+type Options struct {
+	// Dial opens the network connection to the server.
+	Dial     func() (net.Conn, error)
+	ClientID string
+	Username string
+	Password string
+	// CleanSession discards the session state on the server when connecting. If it is not set, subscriptions and
+	// unacknowledged messages are resumed after a reconnect.
+	CleanSession bool
+	// KeepAlive is the maximum time between packets sent to the server, after which a ping is sent. It defaults to
+	// 4 minutes, which is below the idle timeout of most carrier NATs.
+	KeepAlive time.Duration
+	// PingTimeout is the time to wait for a ping response before the connection is considered lost. It defaults to
+	// 30 seconds.
+	PingTimeout time.Duration
+	// ConnectTimeout bounds dialling and the CONNECT handshake. It defaults to 60 seconds.
+	ConnectTimeout time.Duration
+	// Will is published by the server if the connection is lost.
+	Will *Message
+	// AutoReconnect re-establishes lost connections, with delays growing from MinReconnectDelay (5 seconds by
+	// default) to MaxReconnectDelay (5 minutes by default).
+	AutoReconnect     bool
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+	// OnConnect is called whenever a connection has been established.
+	OnConnect func(c *Client, sessionPresent bool)
+	// OnConnectionLost is called whenever an established connection is lost.
+	OnConnectionLost func(c *Client, err error)
+	// DefaultHandler receives messages that do not match any subscription.
+	DefaultHandler MessageHandler
+	// MaxPacketSize is the largest packet accepted from the server; the connection fails on larger ones. It defaults
+	// to 256 KiB, as the body of a packet is held in memory.
+	MaxPacketSize int
+}
+
+var ErrNotConnected = errors.New("mqtt: not connected")
+var ErrConnectionLost = errors.New("mqtt: connection lost")
+var ErrPingTimeout = errors.New("mqtt: ping response timed out")
+var ErrDisconnected = errors.New("mqtt: client disconnected")
+
+// ConnectError is returned when the server refuses a connection.
+type ConnectError struct {
+	ReturnCode byte
+}
+
+var connectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+func (e ConnectError) Error() string {
+	desc, ok := connectErrors[e.ReturnCode]
+	if !ok {
+		desc = "unknown return code"
+	}
+	return fmt.Sprintf("mqtt: connection refused: %s (%d)", desc, e.ReturnCode)
+}
+
+// SubscribeError is returned when the server rejects a subscription.
+type SubscribeError struct {
+	Filter string
+}
+
+func (e SubscribeError) Error() string {
+	return "mqtt: subscription to " + e.Filter + " rejected"
+}
+
+type subscription struct {
+	qos     QoS
+	handler MessageHandler
+}
+
+// operation is a packet awaiting acknowledgement by the server.
+type operation struct {
+	kind     byte
+	message  *Message
+	released bool
+	filters  []string
+	qoss     []QoS
+	handler  MessageHandler
+	done     chan error
+}
+
+// Client is an MQTT 3.1.1 client. It is safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu            sync.Mutex
+	conn          net.Conn
+	connected     bool
+	closing       bool
+	lost          chan struct{}
+	lastID        uint16
+	pending       map[uint16]*operation
+	inflight      []uint16
+	subscriptions map[string]subscription
+	received      map[uint16]bool
+	lastSent      time.Time
+	pingSent      time.Time
+
+	writeMu    sync.Mutex
+	deliveries chan *Message
+	quit       chan struct{}
+}
+
+// NewClient creates a client with the given options. Connect must be called to connect to the server.
+func NewClient(opts Options) *Client {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 4 * time.Minute
+	}
+	if opts.PingTimeout == 0 {
+		opts.PingTimeout = 30 * time.Second
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = 60 * time.Second
+	}
+	if opts.MinReconnectDelay == 0 {
+		opts.MinReconnectDelay = 5 * time.Second
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = 5 * time.Minute
+	}
+	if opts.MaxPacketSize == 0 {
+		opts.MaxPacketSize = 256 << 10
+	}
+	c := &Client{
+		opts:          opts,
+		pending:       make(map[uint16]*operation),
+		subscriptions: make(map[string]subscription),
+		received:      make(map[uint16]bool),
+		deliveries:    make(chan *Message, 64),
+		quit:          make(chan struct{}),
+	}
+	go c.dispatch()
+	return c
+}
+
+// Connect establishes the connection to the server.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrDisconnected
+	}
+	c.mu.Unlock()
+	return c.connect(ctx)
+}
+
+// IsConnected reports whether the client is currently connected to the server.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+	defer cancel()
+
+	type result struct {
+		conn           net.Conn
+		reader         *bufio.Reader
+		sessionPresent bool
+		err            error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := c.opts.Dial()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		r, sessionPresent, err := c.handshake(conn)
+		if err != nil {
+			_ = conn.Close()
+		}
+		results <- result{conn: conn, reader: r, sessionPresent: sessionPresent, err: err}
+	}()
+	var res result
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		// close the connection once the abandoned attempt completes
+		go func() {
+			res := <-results
+			if res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+		return ctx.Err()
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		_ = res.conn.Close()
+		return ErrDisconnected
+	}
+	c.conn = res.conn
+	c.connected = true
+	c.lost = make(chan struct{})
+	c.lastSent = time.Now()
+	c.pingSent = time.Time{}
+	lost := c.lost
+	if !res.sessionPresent {
+		// the server has no session state, so incoming QoS 2 flows cannot be completed
+		c.received = make(map[uint16]bool)
+	}
+	c.mu.Unlock()
+
+	go c.readLoop(res.conn, res.reader)
+	go c.keepAlive(res.conn, lost)
+	c.resume(res.conn, res.sessionPresent)
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c, res.sessionPresent)
+	}
+	return nil
+}
+
+// handshake sends the CONNECT packet and waits for the server's CONNACK.
+func (c *Client) handshake(conn net.Conn) (*bufio.Reader, bool, error) {
+	b, err := encodeConnect(connectOptions{
+		clientID:     c.opts.ClientID,
+		username:     c.opts.Username,
+		password:     c.opts.Password,
+		cleanSession: c.opts.CleanSession,
+		keepAlive:    uint16(c.opts.KeepAlive / time.Second),
+		will:         c.opts.Will,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		return nil, false, err
+	}
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r, c.opts.MaxPacketSize)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.kind != connackPacket {
+		return nil, false, fmt.Errorf("mqtt: expected CONNACK, received packet type %d", p.kind)
+	}
+	if p.returnCode != 0 {
+		return nil, false, ConnectError{ReturnCode: p.returnCode}
+	}
+	return r, p.sessionPresent, nil
+}
+
+// resume restores the subscriptions if the server did not keep the session, and retransmits the messages that
+// have not been acknowledged.
+func (c *Client) resume(conn net.Conn, sessionPresent bool) {
+	var packets [][]byte
+	c.mu.Lock()
+	if !sessionPresent && len(c.subscriptions) > 0 {
+		var filters []string
+		var qoss []QoS
+		for filter, s := range c.subscriptions {
+			filters = append(filters, filter)
+			qoss = append(qoss, s.qos)
+		}
+		id := c.nextID()
+		b, err := encodeSubscribe(id, filters, qoss)
+		if err == nil {
+			c.pending[id] = &operation{kind: subscribePacket, filters: filters, qoss: qoss, done: make(chan error, 1)}
+			packets = append(packets, b)
+		}
+	}
+	for _, id := range c.inflight {
+		op := c.pending[id]
+		var b []byte
+		var err error
+		if op.released {
+			b, err = encodeAck(pubrelPacket, id)
+		} else {
+			b, err = encodePublish(op.message, true)
+		}
+		if err == nil {
+			packets = append(packets, b)
+		}
+	}
+	c.mu.Unlock()
+	for _, b := range packets {
+		if c.write(conn, b) != nil {
+			return
+		}
+	}
+}
+
+// nextID allocates a packet identifier that is not in use. The caller must hold c.mu.
+func (c *Client) nextID() uint16 {
+	for {
+		c.lastID++
+		if c.lastID == 0 {
+			c.lastID = 1
+		}
+		if _, ok := c.pending[c.lastID]; !ok {
+			return c.lastID
+		}
+	}
+}
+
+// write sends an encoded packet, treating a failure as a lost connection.
+func (c *Client) write(conn net.Conn, b []byte) error {
+	c.writeMu.Lock()
+	_, err := conn.Write(b)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.connectionLost(conn, err)
+		return err
+	}
+	c.mu.Lock()
+	c.lastSent = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// currentConn returns the established connection, if any.
+func (c *Client) currentConn() (net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return nil, ErrNotConnected
+	}
+	return c.conn, nil
+}
+
+// Publish sends a message to the server. For QoS 1 and 2 it waits until the server has acknowledged the message.
+// If the connection is lost in the meantime and AutoReconnect is set, the message is retransmitted after the
+// reconnect.
+func (c *Client) Publish(ctx context.Context, topic string, qos QoS, retain bool, payload []byte) error {
+	if qos > ExactlyOnce {
+		return errors.New("mqtt: invalid QoS")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return errors.New("mqtt: topic names may not contain wildcards")
+	}
+	m := &Message{Topic: topic, Payload: payload, QoS: qos, Retained: retain}
+	if qos == AtMostOnce {
+		conn, err := c.currentConn()
+		if err != nil {
+			return err
+		}
+		b, err := encodePublish(m, false)
+		if err != nil {
+			return err
+		}
+		return c.write(conn, b)
+	}
+
+	c.mu.Lock()
+	if c.closing || (!c.connected && !c.opts.AutoReconnect) {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	m.ID = c.nextID()
+	b, err := encodePublish(m, false)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	op := &operation{kind: publishPacket, message: m, done: make(chan error, 1)}
+	c.pending[m.ID] = op
+	c.inflight = append(c.inflight, m.ID)
+	conn, connected := c.conn, c.connected
+	c.mu.Unlock()
+
+	if connected {
+		// a failed write is retried when resuming the session
+		_ = c.write(conn, b)
+	}
+	select {
+	case err := <-op.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe subscribes to the topics matching the filter, delivering their messages to the handler.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos QoS, handler MessageHandler) error {
+	if qos > ExactlyOnce {
+		return errors.New("mqtt: invalid QoS")
+	}
+	op := &operation{
+		kind:    subscribePacket,
+		filters: []string{filter},
+		qoss:    []QoS{qos},
+		handler: handler,
+		done:    make(chan error, 1),
+	}
+	return c.request(ctx, op, func(id uint16) ([]byte, error) {
+		return encodeSubscribe(id, op.filters, op.qoss)
+	})
+}
+
+// Unsubscribe removes the subscriptions to the given filters.
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	op := &operation{kind: unsubscribePacket, filters: filters, done: make(chan error, 1)}
+	return c.request(ctx, op, func(id uint16) ([]byte, error) {
+		return encodeUnsubscribe(id, filters)
+	})
+}
+
+// request sends a packet that is acknowledged by the server, and waits for the acknowledgement.
+func (c *Client) request(ctx context.Context, op *operation, encode func(id uint16) ([]byte, error)) error {
+	c.mu.Lock()
+	if !c.connected {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	id := c.nextID()
+	b, err := encode(id)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.pending[id] = op
+	conn := c.conn
+	c.mu.Unlock()
+
+	err = c.write(conn, b)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-op.done:
+		return err
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Disconnect closes the connection to the server and stops the client.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closing = true
+	conn, connected := c.conn, c.connected
+	c.mu.Unlock()
+	close(c.quit)
+	if !connected {
+		return nil
+	}
+	c.writeMu.Lock()
+	_, err := conn.Write(encodeEmpty(disconnectPacket))
+	c.writeMu.Unlock()
+	c.connectionLost(conn, ErrDisconnected)
+	return err
+}
+
+// connectionLost tears down a connection once, failing the requests waiting on it and starting a reconnect if
+// enabled.
+func (c *Client) connectionLost(conn net.Conn, cause error) {
+	c.mu.Lock()
+	if c.conn != conn || !c.connected {
+		c.mu.Unlock()
+		return
+	}
+	c.connected = false
+	close(c.lost)
+	for id, op := range c.pending {
+		if op.kind != publishPacket {
+			op.done <- ErrConnectionLost
+			delete(c.pending, id)
+		} else if c.closing || !c.opts.AutoReconnect {
+			op.done <- ErrConnectionLost
+			delete(c.pending, id)
+		}
+	}
+	if c.closing || !c.opts.AutoReconnect {
+		c.inflight = nil
+	}
+	reconnect := c.opts.AutoReconnect && !c.closing
+	c.mu.Unlock()
+
+	err := conn.Close()
+	if err != nil {
+		log.Debug().Err(err).Msg("could not close MQTT connection")
+	}
+	if cause != ErrDisconnected {
+		log.Debug().Err(cause).Msg("MQTT connection lost")
+		if c.opts.OnConnectionLost != nil {
+			c.opts.OnConnectionLost(c, cause)
+		}
+	}
+	if reconnect {
+		go c.reconnect()
+	}
+}
+
+// reconnect redials with exponentially growing, jittered delays until a connection is established or the client
+// is disconnected.
+func (c *Client) reconnect() {
+	delay := c.opts.MinReconnectDelay
+	for {
+		jittered := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(jittered):
+		}
+		err := c.connect(context.Background())
+		if err == nil || err == ErrDisconnected {
+			return
+		}
+		log.Debug().Err(err).Msg("could not reconnect to MQTT server")
+		delay *= 2
+		if delay > c.opts.MaxReconnectDelay {
+			delay = c.opts.MaxReconnectDelay
+		}
+	}
+}
+
+// keepAlive sends pings when no other packets have been sent within the keepalive interval, and treats the
+// connection as lost if the server does not respond in time.
+func (c *Client) keepAlive(conn net.Conn, lost chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lost:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			pingSent, lastSent := c.pingSent, c.lastSent
+			if pingSent.IsZero() && now.Sub(lastSent) >= c.opts.KeepAlive {
+				c.pingSent = now
+			}
+			c.mu.Unlock()
+			if !pingSent.IsZero() {
+				if now.Sub(pingSent) > c.opts.PingTimeout {
+					c.connectionLost(conn, ErrPingTimeout)
+					return
+				}
+				continue
+			}
+			if now.Sub(lastSent) >= c.opts.KeepAlive {
+				if c.write(conn, encodeEmpty(pingreqPacket)) != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readLoop reads and handles the packets received on a connection until it fails.
+func (c *Client) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		p, err := readPacket(r, c.opts.MaxPacketSize)
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+		c.mu.Lock()
+		// any packet shows that the connection is alive
+		c.pingSent = time.Time{}
+		c.mu.Unlock()
+		err = c.handle(conn, p)
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+	}
+}
+
+func (c *Client) handle(conn net.Conn, p *packet) error {
+	switch p.kind {
+	case publishPacket:
+		m := &Message{
+			Topic:     p.topic,
+			Payload:   p.payload,
+			QoS:       p.qos,
+			Retained:  p.retain,
+			Duplicate: p.dup,
+			ID:        p.id,
+		}
+		switch p.qos {
+		case AtMostOnce:
+			c.deliver(m)
+		case AtLeastOnce:
+			c.deliver(m)
+			return c.ack(conn, pubackPacket, p.id)
+		case ExactlyOnce:
+			c.mu.Lock()
+			duplicate := c.received[p.id]
+			c.received[p.id] = true
+			c.mu.Unlock()
+			if !duplicate {
+				c.deliver(m)
+			}
+			return c.ack(conn, pubrecPacket, p.id)
+		}
+	case pubrelPacket:
+		c.mu.Lock()
+		delete(c.received, p.id)
+		c.mu.Unlock()
+		return c.ack(conn, pubcompPacket, p.id)
+	case pubrecPacket:
+		c.mu.Lock()
+		if op, ok := c.pending[p.id]; ok && op.kind == publishPacket {
+			op.released = true
+		}
+		c.mu.Unlock()
+		return c.ack(conn, pubrelPacket, p.id)
+	case pubackPacket, pubcompPacket:
+		op := c.complete(p.id, publishPacket)
+		if op != nil {
+			op.done <- nil
+		}
+	case subackPacket:
+		op := c.complete(p.id, subscribePacket)
+		if op == nil {
+			return nil
+		}
+		var err error
+		c.mu.Lock()
+		for i, filter := range op.filters {
+			if i < len(p.returnCodes) && p.returnCodes[i] == 0x80 {
+				err = SubscribeError{Filter: filter}
+				continue
+			}
+			handler := op.handler
+			if handler == nil {
+				// resubscribed after a reconnect
+				handler = c.subscriptions[filter].handler
+			}
+			c.subscriptions[filter] = subscription{qos: op.qoss[i], handler: handler}
+		}
+		c.mu.Unlock()
+		op.done <- err
+	case unsubackPacket:
+		op := c.complete(p.id, unsubscribePacket)
+		if op == nil {
+			return nil
+		}
+		c.mu.Lock()
+		for _, filter := range op.filters {
+			delete(c.subscriptions, filter)
+		}
+		c.mu.Unlock()
+		op.done <- nil
+	}
+	return nil
+}
+
+// complete removes and returns the pending operation acknowledged by a packet.
+func (c *Client) complete(id uint16, kind byte) *operation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	op, ok := c.pending[id]
+	if !ok || op.kind != kind {
+		return nil
+	}
+	delete(c.pending, id)
+	if kind == publishPacket {
+		for i, inflight := range c.inflight {
+			if inflight == id {
+				c.inflight = append(c.inflight[:i], c.inflight[i+1:]...)
+				break
+			}
+		}
+	}
+	return op
+}
+
+func (c *Client) ack(conn net.Conn, kind byte, id uint16) error {
+	b, err := encodeAck(kind, id)
+	if err != nil {
+		return err
+	}
+	return c.write(conn, b)
+}
+
+// deliver queues a received message for its handlers.
+func (c *Client) deliver(m *Message) {
+	select {
+	case c.deliveries <- m:
+	case <-c.quit:
+	}
+}
+
+// dispatch calls the handlers of received messages until the client is disconnected.
+func (c *Client) dispatch() {
+	for {
+		select {
+		case <-c.quit:
+			return
+		case m := <-c.deliveries:
+			var handlers []MessageHandler
+			c.mu.Lock()
+			for filter, s := range c.subscriptions {
+				if s.handler != nil && topicMatches(filter, m.Topic) {
+					handlers = append(handlers, s.handler)
+				}
+			}
+			c.mu.Unlock()
+			if len(handlers) == 0 && c.opts.DefaultHandler != nil {
+				handlers = append(handlers, c.opts.DefaultHandler)
+			}
+			for _, handler := range handlers {
+				handler(m)
+			}
+		}
+	}
+}
+
+// topicMatches reports whether a topic name matches a topic filter, which may contain the + and # wildcards.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	// topics starting with $ are not matched by wildcards at the first level
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,319 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeBroker is the server end of a net.Pipe, which reads the packets of the client and answers them as a test
+// directs.
+type fakeBroker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// clientPacket is a packet sent by the client, with its body still encoded.
+type clientPacket struct {
+	kind  byte
+	flags byte
+	body  *decoder
+}
+
+// newBrokerClient creates a client whose Dial returns the client end of a pipe to the broker.
+func newBrokerClient(t *testing.T, opts Options) (*Client, *fakeBroker) {
+	client, server := net.Pipe()
+	b := &fakeBroker{t: t, conn: server, r: bufio.NewReader(server)}
+	opts.Dial = func() (net.Conn, error) {
+		return client, nil
+	}
+	return NewClient(opts), b
+}
+
+// expect reads the next packet of the client, failing the test unless it is of the given type.
+func (b *fakeBroker) expect(kind byte) clientPacket {
+	b.t.Helper()
+	_ = b.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, err := b.r.ReadByte()
+	if err != nil {
+		b.t.Fatalf("expected packet type %d: %v", kind, err)
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := b.r.ReadByte()
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(b.r, body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	p := clientPacket{kind: header >> 4, flags: header & 0x0f, body: &decoder{b: body}}
+	if p.kind != kind {
+		b.t.Fatalf("received packet type %d, want %d", p.kind, kind)
+	}
+	return p
+}
+
+func (b *fakeBroker) send(data []byte, err error) {
+	b.t.Helper()
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	_ = b.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = b.conn.Write(data)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// accept completes the CONNECT handshake.
+func (b *fakeBroker) accept(sessionPresent bool) clientPacket {
+	b.t.Helper()
+	p := b.expect(connectPacket)
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	b.send([]byte{connackPacket << 4, 2, flags, 0}, nil)
+	return p
+}
+
+// close discards the remaining packets of the client, such as DISCONNECT, and closes the pipe.
+func (b *fakeBroker) close(c *Client) {
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, b.conn)
+	}()
+	_ = c.Disconnect()
+	_ = b.conn.Close()
+}
+
+// connect connects the client to the broker.
+func connect(t *testing.T, c *Client, b *fakeBroker) {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Connect(context.Background())
+	}()
+	b.accept(false)
+	err := <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConnect(t *testing.T) {
+	c, b := newBrokerClient(t, Options{ClientID: "device-1", Username: "user", Password: "secret",
+		CleanSession: true, KeepAlive: time.Minute})
+	connected := make(chan bool, 1)
+	c.opts.OnConnect = func(c *Client, sessionPresent bool) {
+		connected <- sessionPresent
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Connect(context.Background())
+	}()
+	p := b.accept(true)
+	if name := p.body.string(); name != "MQTT" {
+		t.Errorf("protocol name %q", name)
+	}
+	if level := p.body.byte(); level != 4 {
+		t.Errorf("protocol level %d", level)
+	}
+	if flags := p.body.byte(); flags != 0xc2 {
+		t.Errorf("connect flags %#x, want 0xc2", flags)
+	}
+	if keepAlive := p.body.uint16(); keepAlive != 60 {
+		t.Errorf("keepalive %d", keepAlive)
+	}
+	for _, want := range []string{"device-1", "user", "secret"} {
+		if field := p.body.string(); field != want {
+			t.Errorf("field %q, want %q", field, want)
+		}
+	}
+	err := <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsConnected() {
+		t.Error("not connected after CONNACK")
+	}
+	if sessionPresent := <-connected; !sessionPresent {
+		t.Error("session present flag not reported")
+	}
+	b.close(c)
+	if c.IsConnected() {
+		t.Error("connected after Disconnect")
+	}
+}
+
+func TestClientConnectRefused(t *testing.T) {
+	c, b := newBrokerClient(t, Options{ClientID: "device-1"})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Connect(context.Background())
+	}()
+	b.expect(connectPacket)
+	b.send([]byte{connackPacket << 4, 2, 0, 5}, nil)
+	err := <-errs
+	if err != (ConnectError{ReturnCode: 5}) {
+		t.Errorf("got %v, want ConnectError 5", err)
+	}
+	_ = c.Disconnect()
+}
+
+func TestClientSubscribe(t *testing.T) {
+	c, b := newBrokerClient(t, Options{ClientID: "device-1"})
+	connect(t, c, b)
+	defer b.close(c)
+
+	received := make(chan *Message, 4)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Subscribe(context.Background(), "sensors/+", ExactlyOnce, func(m *Message) {
+			received <- m
+		})
+	}()
+	p := b.expect(subscribePacket)
+	if p.flags != 0x02 {
+		t.Errorf("SUBSCRIBE flags %#x", p.flags)
+	}
+	id := p.body.uint16()
+	if filter, qos := p.body.string(), p.body.byte(); filter != "sensors/+" || qos != 2 {
+		t.Errorf("subscribed to %q at QoS %d", filter, qos)
+	}
+	b.send([]byte{subackPacket << 4, 3, byte(id >> 8), byte(id), 2}, nil)
+	err := <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// QoS 0 needs no acknowledgement
+	b.send(encodePublish(&Message{Topic: "sensors/a", Payload: []byte("0")}, false))
+	// QoS 1 is acknowledged with PUBACK
+	b.send(encodePublish(&Message{Topic: "sensors/b", Payload: []byte("1"), QoS: AtLeastOnce, ID: 7}, false))
+	if ack := b.expect(pubackPacket); ack.body.uint16() != 7 {
+		t.Error("PUBACK for the wrong packet")
+	}
+	// QoS 2 is acknowledged with PUBREC, and completed with PUBCOMP once released; a duplicate is not delivered
+	m := &Message{Topic: "sensors/c", Payload: []byte("2"), QoS: ExactlyOnce, ID: 8}
+	b.send(encodePublish(m, false))
+	if rec := b.expect(pubrecPacket); rec.body.uint16() != 8 {
+		t.Error("PUBREC for the wrong packet")
+	}
+	b.send(encodePublish(m, true))
+	b.expect(pubrecPacket)
+	b.send(encodeAck(pubrelPacket, 8))
+	if comp := b.expect(pubcompPacket); comp.body.uint16() != 8 {
+		t.Error("PUBCOMP for the wrong packet")
+	}
+
+	for _, want := range []string{"0", "1", "2"} {
+		select {
+		case m := <-received:
+			if string(m.Payload) != want {
+				t.Errorf("received %q, want %q", m.Payload, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %q not delivered", want)
+		}
+	}
+	select {
+	case m := <-received:
+		t.Errorf("duplicate delivered: %q", m.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientSubscribeRejected(t *testing.T) {
+	c, b := newBrokerClient(t, Options{ClientID: "device-1"})
+	connect(t, c, b)
+	defer b.close(c)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Subscribe(context.Background(), "private/#", AtMostOnce, nil)
+	}()
+	id := b.expect(subscribePacket).body.uint16()
+	b.send([]byte{subackPacket << 4, 3, byte(id >> 8), byte(id), 0x80}, nil)
+	err := <-errs
+	if err != (SubscribeError{Filter: "private/#"}) {
+		t.Errorf("got %v, want SubscribeError", err)
+	}
+}
+
+func TestClientPublish(t *testing.T) {
+	c, b := newBrokerClient(t, Options{ClientID: "device-1"})
+	connect(t, c, b)
+	defer b.close(c)
+
+	for _, qos := range []QoS{AtMostOnce, AtLeastOnce, ExactlyOnce} {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- c.Publish(context.Background(), "status", qos, true, []byte("up"))
+		}()
+		p := b.expect(publishPacket)
+		if want := byte(qos)<<1 | 0x01; p.flags != want {
+			t.Errorf("QoS %d: PUBLISH flags %#x, want %#x", qos, p.flags, want)
+		}
+		if topic := p.body.string(); topic != "status" {
+			t.Errorf("QoS %d: topic %q", qos, topic)
+		}
+		switch qos {
+		case AtLeastOnce:
+			b.send(encodeAck(pubackPacket, p.body.uint16()))
+		case ExactlyOnce:
+			id := p.body.uint16()
+			b.send(encodeAck(pubrecPacket, id))
+			rel := b.expect(pubrelPacket)
+			if rel.flags != 0x02 || rel.body.uint16() != id {
+				t.Errorf("PUBREL flags %#x for the wrong packet", rel.flags)
+			}
+			b.send(encodeAck(pubcompPacket, id))
+		}
+		if payload := p.body.rest(); string(payload) != "up" {
+			t.Errorf("QoS %d: payload %q", qos, payload)
+		}
+		err := <-errs
+		if err != nil {
+			t.Errorf("QoS %d: %v", qos, err)
+		}
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	lost := make(chan error, 1)
+	c, b := newBrokerClient(t, Options{ClientID: "device-1", KeepAlive: time.Second, PingTimeout: time.Second,
+		OnConnectionLost: func(c *Client, err error) {
+			lost <- err
+		}})
+	connect(t, c, b)
+	defer b.close(c)
+
+	b.expect(pingreqPacket)
+	b.send(encodeEmpty(pingrespPacket), nil)
+	if !c.IsConnected() {
+		t.Fatal("disconnected after PINGRESP")
+	}
+	// an unanswered ping loses the connection
+	b.expect(pingreqPacket)
+	select {
+	case err := <-lost:
+		if err != ErrPingTimeout {
+			t.Errorf("connection lost with %v, want ErrPingTimeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection not lost after an unanswered ping")
+	}
+}
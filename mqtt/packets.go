@@ -0,0 +1,310 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// control packet types
+const (
+	connectPacket     byte = 1
+	connackPacket     byte = 2
+	publishPacket     byte = 3
+	pubackPacket      byte = 4
+	pubrecPacket      byte = 5
+	pubrelPacket      byte = 6
+	pubcompPacket     byte = 7
+	subscribePacket   byte = 8
+	subackPacket      byte = 9
+	unsubscribePacket byte = 10
+	unsubackPacket    byte = 11
+	pingreqPacket     byte = 12
+	pingrespPacket    byte = 13
+	disconnectPacket  byte = 14
+)
+
+// maxRemainingLength is the largest remaining length that can be encoded in a fixed header.
+const maxRemainingLength = 268435455
+
+// packet is a decoded MQTT control packet. Only the fields of its type are set.
+type packet struct {
+	kind  byte
+	flags byte
+	id    uint16
+
+	// CONNACK
+	sessionPresent bool
+	returnCode     byte
+
+	// PUBLISH
+	topic   string
+	payload []byte
+	qos     QoS
+	retain  bool
+	dup     bool
+
+	// SUBSCRIBE, SUBACK and UNSUBSCRIBE
+	filters     []string
+	qoss        []QoS
+	returnCodes []byte
+}
+
+// connectOptions holds the fields of a CONNECT packet.
+type connectOptions struct {
+	clientID     string
+	username     string
+	password     string
+	cleanSession bool
+	keepAlive    uint16
+	will         *Message
+}
+
+// maxFieldLength is the largest string or binary field, whose length is encoded in two bytes.
+const maxFieldLength = 65535
+
+// encoder appends the fields of a packet body, recording the first error.
+type encoder struct {
+	b   []byte
+	err error
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+func (e *encoder) bytes(d []byte) {
+	if len(d) > maxFieldLength {
+		if e.err == nil {
+			e.err = fmt.Errorf("mqtt: field of %d bytes exceeds the maximum of %d", len(d), maxFieldLength)
+		}
+		return
+	}
+	e.uint16(uint16(len(d)))
+	e.b = append(e.b, d...)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+// frame prefixes the variable header and payload with the fixed header.
+func (e *encoder) frame(kind byte, flags byte) ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	if len(e.b) > maxRemainingLength {
+		return nil, errors.New("mqtt: packet too large")
+	}
+	b := []byte{kind<<4 | flags}
+	n := len(e.b)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, e.b...), nil
+}
+
+func encodeConnect(o connectOptions) ([]byte, error) {
+	if o.password != "" && o.username == "" {
+		// MQTT 3.1.1 section 3.1.2.9
+		return nil, errors.New("mqtt: a password requires a username")
+	}
+	var flags byte
+	if o.cleanSession {
+		flags |= 0x02
+	}
+	if o.will != nil {
+		flags |= 0x04 | byte(o.will.QoS)<<3
+		if o.will.Retained {
+			flags |= 0x20
+		}
+	}
+	if o.password != "" {
+		flags |= 0x40
+	}
+	if o.username != "" {
+		flags |= 0x80
+	}
+	e := &encoder{}
+	e.string("MQTT")
+	// protocol level 4 is MQTT 3.1.1
+	e.b = append(e.b, 4, flags)
+	e.uint16(o.keepAlive)
+	e.string(o.clientID)
+	if o.will != nil {
+		e.string(o.will.Topic)
+		e.bytes(o.will.Payload)
+	}
+	if o.username != "" {
+		e.string(o.username)
+	}
+	if o.password != "" {
+		e.string(o.password)
+	}
+	return e.frame(connectPacket, 0)
+}
+
+func encodePublish(m *Message, dup bool) ([]byte, error) {
+	flags := byte(m.QoS) << 1
+	if dup {
+		flags |= 0x08
+	}
+	if m.Retained {
+		flags |= 0x01
+	}
+	e := &encoder{}
+	e.string(m.Topic)
+	if m.QoS > AtMostOnce {
+		e.uint16(m.ID)
+	}
+	e.b = append(e.b, m.Payload...)
+	return e.frame(publishPacket, flags)
+}
+
+// encodeAck encodes the packets that only carry a packet identifier.
+func encodeAck(kind byte, id uint16) ([]byte, error) {
+	var flags byte
+	if kind == pubrelPacket {
+		flags = 0x02
+	}
+	e := &encoder{}
+	e.uint16(id)
+	return e.frame(kind, flags)
+}
+
+func encodeSubscribe(id uint16, filters []string, qoss []QoS) ([]byte, error) {
+	e := &encoder{}
+	e.uint16(id)
+	for i, f := range filters {
+		e.string(f)
+		e.b = append(e.b, byte(qoss[i]))
+	}
+	return e.frame(subscribePacket, 0x02)
+}
+
+func encodeUnsubscribe(id uint16, filters []string) ([]byte, error) {
+	e := &encoder{}
+	e.uint16(id)
+	for _, f := range filters {
+		e.string(f)
+	}
+	return e.frame(unsubscribePacket, 0x02)
+}
+
+func encodeEmpty(kind byte) []byte {
+	return []byte{kind << 4, 0}
+}
+
+// readPacket reads and decodes the next control packet, refusing packets larger than maxSize.
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("mqtt: malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("mqtt: packet of %d bytes exceeds the maximum of %d", length, maxSize)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	p := &packet{kind: header >> 4, flags: header & 0x0f}
+	d := decoder{b: body}
+	switch p.kind {
+	case connackPacket:
+		flags := d.byte()
+		p.sessionPresent = flags&0x01 != 0
+		p.returnCode = d.byte()
+	case publishPacket:
+		p.dup = p.flags&0x08 != 0
+		p.qos = QoS(p.flags >> 1 & 0x03)
+		p.retain = p.flags&0x01 != 0
+		p.topic = d.string()
+		if p.qos > AtMostOnce {
+			p.id = d.uint16()
+		}
+		p.payload = d.rest()
+	case pubackPacket, pubrecPacket, pubrelPacket, pubcompPacket, unsubackPacket:
+		p.id = d.uint16()
+	case subackPacket:
+		p.id = d.uint16()
+		p.returnCodes = d.rest()
+	case pingrespPacket:
+	default:
+		return nil, fmt.Errorf("mqtt: unexpected packet type %d", p.kind)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+// decoder reads the fields of a packet body, recording the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.b) < 2 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint16())
+	if len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *decoder) rest() []byte {
+	v := d.b
+	d.b = nil
+	return v
+}
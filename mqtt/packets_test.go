@@ -0,0 +1,251 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemainingLength(t *testing.T) {
+	for _, test := range []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		e := &encoder{b: make([]byte, test.length)}
+		b, err := e.frame(pingrespPacket, 0)
+		if err != nil {
+			t.Fatalf("%d: %v", test.length, err)
+		}
+		if !bytes.Equal(b[1:1+len(test.header)], test.header) {
+			t.Errorf("%d: encoded as % x, want % x", test.length, b[1:1+len(test.header)], test.header)
+		}
+		if len(b) != 1+len(test.header)+test.length {
+			t.Errorf("%d: packet of %d bytes", test.length, len(b))
+		}
+		// a PUBLISH body of the same length decodes back to its payload
+		e = &encoder{}
+		e.string("t")
+		e.b = append(e.b, make([]byte, test.length)...)
+		b, err = e.frame(publishPacket, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(b)), maxRemainingLength)
+		if err != nil {
+			t.Fatalf("%d: %v", test.length, err)
+		}
+		if len(p.payload) != test.length {
+			t.Errorf("%d: decoded a payload of %d bytes", test.length, len(p.payload))
+		}
+	}
+}
+
+func TestReadPacketErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		maxSize int
+		err     string
+	}{
+		{"malformed length", []byte{0xd0, 0x80, 0x80, 0x80, 0x80, 0x01}, 1 << 20, "malformed remaining length"},
+		{"too large", []byte{0x30, 0x80, 0x01}, 127, "exceeds the maximum of 127"},
+		{"truncated body", []byte{0x20, 0x02, 0x00}, 1 << 20, "EOF"},
+		{"short field", []byte{0x40, 0x01, 0x00}, 1 << 20, "unexpected EOF"},
+		{"client packet", []byte{0x80, 0x00}, 1 << 20, "unexpected packet type 8"},
+	} {
+		_, err := readPacket(bufio.NewReader(bytes.NewReader(test.data)), test.maxSize)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		encode func() ([]byte, error)
+		want   packet
+	}{
+		{
+			"publish qos 0",
+			func() ([]byte, error) {
+				return encodePublish(&Message{Topic: "a/b", Payload: []byte("hi")}, false)
+			},
+			packet{kind: publishPacket, topic: "a/b", payload: []byte("hi")},
+		},
+		{
+			"publish qos 1 retained",
+			func() ([]byte, error) {
+				return encodePublish(&Message{Topic: "a", Payload: []byte("x"), QoS: AtLeastOnce, Retained: true,
+					ID: 10}, false)
+			},
+			packet{kind: publishPacket, flags: 0x03, id: 10, topic: "a", payload: []byte("x"), qos: AtLeastOnce,
+				retain: true},
+		},
+		{
+			"publish qos 2 duplicate",
+			func() ([]byte, error) {
+				return encodePublish(&Message{Topic: "a", QoS: ExactlyOnce, ID: 65535}, true)
+			},
+			packet{kind: publishPacket, flags: 0x0c, id: 65535, topic: "a", payload: []byte{}, qos: ExactlyOnce,
+				dup: true},
+		},
+		{
+			"puback",
+			func() ([]byte, error) { return encodeAck(pubackPacket, 1) },
+			packet{kind: pubackPacket, id: 1},
+		},
+		{
+			"pubrec",
+			func() ([]byte, error) { return encodeAck(pubrecPacket, 2) },
+			packet{kind: pubrecPacket, id: 2},
+		},
+		{
+			"pubrel",
+			func() ([]byte, error) { return encodeAck(pubrelPacket, 3) },
+			packet{kind: pubrelPacket, flags: 0x02, id: 3},
+		},
+		{
+			"pubcomp",
+			func() ([]byte, error) { return encodeAck(pubcompPacket, 4) },
+			packet{kind: pubcompPacket, id: 4},
+		},
+		{
+			"unsuback",
+			func() ([]byte, error) { return encodeAck(unsubackPacket, 5) },
+			packet{kind: unsubackPacket, id: 5},
+		},
+		{
+			"connack",
+			func() ([]byte, error) { return []byte{0x20, 0x02, 0x01, 0x05}, nil },
+			packet{kind: connackPacket, sessionPresent: true, returnCode: 5},
+		},
+		{
+			"suback",
+			func() ([]byte, error) { return []byte{0x90, 0x04, 0x00, 0x06, 0x01, 0x80}, nil },
+			packet{kind: subackPacket, id: 6, returnCodes: []byte{0x01, 0x80}},
+		},
+		{
+			"pingresp",
+			func() ([]byte, error) { return encodeEmpty(pingrespPacket), nil },
+			packet{kind: pingrespPacket},
+		},
+	} {
+		b, err := test.encode()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(b)), 1<<20)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(*p, test.want) {
+			t.Errorf("%s: decoded %+v, want %+v", test.name, *p, test.want)
+		}
+	}
+}
+
+func TestEncodeClientPackets(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		encode func() ([]byte, error)
+		want   []byte
+	}{
+		{
+			"connect",
+			func() ([]byte, error) {
+				return encodeConnect(connectOptions{clientID: "c", username: "u", password: "p",
+					cleanSession: true, keepAlive: 60,
+					will: &Message{Topic: "w", Payload: []byte("x"), QoS: AtLeastOnce, Retained: true}})
+			},
+			[]byte{0x10, 25, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xee, 0, 60, 0, 1, 'c', 0, 1, 'w', 0, 1, 'x', 0, 1, 'u',
+				0, 1, 'p'},
+		},
+		{
+			"connect without credentials",
+			func() ([]byte, error) { return encodeConnect(connectOptions{clientID: "c"}) },
+			[]byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0, 0, 0, 0, 1, 'c'},
+		},
+		{
+			"subscribe",
+			func() ([]byte, error) {
+				return encodeSubscribe(7, []string{"a/#", "b"}, []QoS{ExactlyOnce, AtMostOnce})
+			},
+			[]byte{0x82, 12, 0, 7, 0, 3, 'a', '/', '#', 2, 0, 1, 'b', 0},
+		},
+		{
+			"unsubscribe",
+			func() ([]byte, error) { return encodeUnsubscribe(8, []string{"a/#"}) },
+			[]byte{0xa2, 7, 0, 8, 0, 3, 'a', '/', '#'},
+		},
+		{
+			"disconnect",
+			func() ([]byte, error) { return encodeEmpty(disconnectPacket), nil },
+			[]byte{0xe0, 0},
+		},
+	} {
+		b, err := test.encode()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(b, test.want) {
+			t.Errorf("%s: encoded % x, want % x", test.name, b, test.want)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	_, err := encodeConnect(connectOptions{clientID: "c", password: "p"})
+	if err == nil {
+		t.Error("password without a username: got no error")
+	}
+	_, err = encodePublish(&Message{Topic: strings.Repeat("t", maxFieldLength+1)}, false)
+	if err == nil {
+		t.Error("oversized topic: got no error")
+	}
+	_, err = encodeConnect(connectOptions{clientID: "c",
+		will: &Message{Topic: "w", Payload: make([]byte, maxFieldLength+1)}})
+	if err == nil {
+		t.Error("oversized will payload: got no error")
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"+", "/a", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"a/+/#", "a/b", true},
+		{"a/+", "a/", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	} {
+		if match := topicMatches(test.filter, test.topic); match != test.match {
+			t.Errorf("topicMatches(%q, %q) = %t, want %t", test.filter, test.topic, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pingTimeUnit is the resolution of the timeout and reply times of AT+CIPPING.
+const pingTimeUnit = 100 * time.Millisecond
+
+var pingLineRegexp = regexp.MustCompile(fmt.Sprintf(`^(\+CIPPING: .*|%s|%s)$`,
+	string(OkResponse),
+	string(ErrorResponse)))
+var pingReplyRegexp = regexp.MustCompile(`^\+CIPPING: ([0-9]+),"?([^",]*)"?,([0-9]+),([0-9]+)$`)
+
+// PingReply describes the reply to a single echo request.
+type PingReply struct {
+	// Seq is the sequence number of the echo request, starting at 1.
+	Seq int
+	// Addr is the address that replied.
+	Addr string
+	// RTT is the round-trip time, with a resolution of 100ms.
+	RTT time.Duration
+	// TTL is the time to live of the reply.
+	TTL int
+	// Lost is set if no reply was received within the timeout.
+	Lost bool
+}
+
+// PingResult holds the replies and summary statistics of a ping.
+type PingResult struct {
+	Host        string
+	Replies     []PingReply
+	Transmitted int
+	Received    int
+	MinRTT      time.Duration
+	AvgRTT      time.Duration
+	MaxRTT      time.Duration
+	StdDevRTT   time.Duration
+}
+
+// Loss returns the fraction of echo requests that were not answered.
+func (r *PingResult) Loss() float64 {
+	if r.Transmitted == 0 {
+		return 0
+	}
+	return float64(r.Transmitted-r.Received) / float64(r.Transmitted)
+}
+
+// String formats the result in the style of the ping tool.
+func (r *PingResult) String() string {
+	var b strings.Builder
+	for _, reply := range r.Replies {
+		if reply.Lost {
+			fmt.Fprintf(&b, "request timeout for icmp_seq %d\n", reply.Seq)
+			continue
+		}
+		fmt.Fprintf(&b, "reply from %s: icmp_seq=%d ttl=%d time=%v\n", reply.Addr, reply.Seq, reply.TTL, reply.RTT)
+	}
+	fmt.Fprintf(&b, "--- %s ping statistics ---\n", r.Host)
+	fmt.Fprintf(&b, "%d packets transmitted, %d packets received, %.1f%% packet loss\n",
+		r.Transmitted, r.Received, r.Loss()*100)
+	if r.Received > 0 {
+		fmt.Fprintf(&b, "round-trip min/avg/max/stddev = %v/%v/%v/%v\n", r.MinRTT, r.AvgRTT, r.MaxRTT, r.StdDevRTT)
+	}
+	return b.String()
+}
+
+// Ping sends count ICMP echo requests of size bytes to the given host (AT+CIPPING), waiting up to timeout for each
+// reply. It can be used to tell an unreachable host apart from a closed port when OpenTcpConnection fails. The GPRS
+// context must have been activated.
+func (g *DefaultGsmModule) Ping(host string, count int, size int, timeout time.Duration) (*PingResult, error) {
+	if count < 1 || count > 100 {
+		return nil, errors.New("ping count must be between 1 and 100")
+	}
+	if size < 0 || size > 1024 {
+		return nil, errors.New("ping size must be between 0 and 1024")
+	}
+	units := int(timeout / pingTimeUnit)
+	if units < 1 || units > 600 {
+		return nil, errors.New("ping timeout must be between 100ms and 60s")
+	}
+	err := g.sendCommand(fmt.Sprintf(string(PingCommand), host, count, size, units))
+	if err != nil {
+		return nil, errors.New("could not ping:" + err.Error())
+	}
+	result := &PingResult{Host: host}
+	deadline := time.Now().Add(time.Duration(count)*timeout + 5*time.Second)
+	for {
+		line, err := g.waitForLine(pingLineRegexp, time.Until(deadline))
+		if err != nil {
+			return nil, errors.New("could not ping:" + err.Error())
+		}
+		if line == string(OkResponse) {
+			break
+		}
+		if line == string(ErrorResponse) {
+			return nil, errors.New("could not ping " + host)
+		}
+		s := pingReplyRegexp.FindStringSubmatch(line)
+		if s == nil {
+			return nil, errors.New("unexpected ping reply: " + line)
+		}
+		seq, _ := strconv.Atoi(s[1])
+		replyTime, _ := strconv.Atoi(s[3])
+		ttl, _ := strconv.Atoi(s[4])
+		result.Replies = append(result.Replies, PingReply{
+			Seq:  seq,
+			Addr: s[2],
+			RTT:  time.Duration(replyTime) * pingTimeUnit,
+			TTL:  ttl,
+			Lost: replyTime >= units,
+		})
+	}
+	result.summarise()
+	return result, nil
+}
+
+// summarise calculates the summary statistics from the replies.
+func (r *PingResult) summarise() {
+	r.Transmitted = len(r.Replies)
+	var sum, sumSquares float64
+	for _, reply := range r.Replies {
+		if reply.Lost {
+			continue
+		}
+		r.Received++
+		if r.Received == 1 || reply.RTT < r.MinRTT {
+			r.MinRTT = reply.RTT
+		}
+		if reply.RTT > r.MaxRTT {
+			r.MaxRTT = reply.RTT
+		}
+		sum += float64(reply.RTT)
+		sumSquares += float64(reply.RTT) * float64(reply.RTT)
+	}
+	if r.Received == 0 {
+		return
+	}
+	mean := sum / float64(r.Received)
+	r.AvgRTT = time.Duration(mean)
+	r.StdDevRTT = time.Duration(math.Sqrt(math.Max(sumSquares/float64(r.Received)-mean*mean, 0)))
+}
@@ -0,0 +1,442 @@
+package gsmtcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bouwerp/gsmtcp/jsonrpc"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of queued items.
+const (
+	QueueItemCall    = "call"
+	QueueItemMessage = "message"
+)
+
+// deadLetterDir is the directory, within the queue's directory, into which items that cannot be delivered are moved.
+const deadLetterDir = "dead"
+
+// QueueOptions configures a Queue.
+type QueueOptions struct {
+	// MaxBytes caps the total size of the queued items on disk. It defaults to 10 MiB.
+	MaxBytes int64
+	// MaxAttempts is the number of failed deliveries after which an item is dead-lettered. Only failures once
+	// connected count, such as an error response or a failed write. It defaults to 5.
+	MaxAttempts int
+}
+
+// QueueItem is an item waiting in a Queue: either a JSON-RPC call or a raw message.
+type QueueItem struct {
+	// ID is a ULID, which is also sent as the id of a call so that the server can discard duplicate deliveries.
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// URL, Method and Params describe a call.
+	URL    string          `json:"url,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// Data is the content of a raw message.
+	Data      []byte    `json:"data,omitempty"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+
+	seq  uint64
+	size int64
+}
+
+// Queue is a disk-backed store-and-forward queue for outbound calls and messages, which buffers them while the link
+// is down and delivers them in order once a connection is up. Each item is a file in the queue's directory, written
+// to a temporary file and renamed into place, so that a crash never leaves a partial item behind. Items that fail
+// MaxAttempts times, or that the server rejects, are moved to the dead-letter directory "dead".
+type Queue struct {
+	dir  string
+	opts QueueOptions
+
+	// drainMu serialises drains, while mu guards the fields below
+	drainMu sync.Mutex
+	mu      sync.Mutex
+	nextSeq uint64
+	size    int64
+}
+
+// OpenQueue opens the queue stored in the directory, creating it if needed. Items queued before a restart are kept.
+func OpenQueue(dir string, opts QueueOptions) (*Queue, error) {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = 10 << 20
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = 5
+	}
+	err := os.MkdirAll(filepath.Join(dir, deadLetterDir), 0755)
+	if err != nil {
+		return nil, errors.New("could not create queue:" + err.Error())
+	}
+	q := &Queue{dir: dir, opts: opts}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.New("could not open queue:" + err.Error())
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			// left behind by a crash before the rename
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		seq, ok := parseQueueFileName(e.Name())
+		if !ok {
+			continue
+		}
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+		q.size += e.Size()
+	}
+	return q, nil
+}
+
+// queueFileName names an item's file so that the names sort in queue order.
+func queueFileName(seq uint64, id string) string {
+	return fmt.Sprintf("%020d-%s.json", seq, id)
+}
+
+func parseQueueFileName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return 0, false
+	}
+	i := strings.IndexByte(name, '-')
+	if i < 0 {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(name[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// EnqueueCall queues a JSON-RPC call to the method at the URL, returning the item's id. The params are sent as
+// given, so they must be an array or an object; the result of the call is discarded.
+func (q *Queue) EnqueueCall(url, method string, params interface{}) (string, error) {
+	item := &QueueItem{Kind: QueueItemCall, URL: url, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return "", errors.New("could not encode params:" + err.Error())
+		}
+		item.Params = b
+	}
+	return q.enqueue(item)
+}
+
+// EnqueueMessage queues a raw message, which is written as it is to the connection given to FlushMessages.
+func (q *Queue) EnqueueMessage(data []byte) (string, error) {
+	return q.enqueue(&QueueItem{Kind: QueueItemMessage, Data: data})
+}
+
+func (q *Queue) enqueue(item *QueueItem) (string, error) {
+	item.ID = jsonrpc.NewULID()
+	item.Created = time.Now()
+	b, err := json.Marshal(item)
+	if err != nil {
+		return "", errors.New("could not encode item:" + err.Error())
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size+int64(len(b)) > q.opts.MaxBytes {
+		return "", QueueFullErr{}
+	}
+	err = writeFileAtomic(filepath.Join(q.dir, queueFileName(q.nextSeq, item.ID)), b)
+	if err != nil {
+		return "", errors.New("could not store item:" + err.Error())
+	}
+	q.nextSeq++
+	q.size += int64(len(b))
+	return item.ID, nil
+}
+
+// writeFileAtomic writes the file through a synced temporary file, so that it either exists in full or not at all.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir flushes the entries of the directory, so that a rename or removal in it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Len returns the number of queued items, excluding dead-lettered ones.
+func (q *Queue) Len() (int, error) {
+	items, err := q.items()
+	return len(items), err
+}
+
+// Size returns the total size of the queued items on disk.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// items returns the queued items in order.
+func (q *Queue) items() ([]*QueueItem, error) {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, errors.New("could not read queue:" + err.Error())
+	}
+	var items []*QueueItem
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		seq, ok := parseQueueFileName(e.Name())
+		if !ok {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(q.dir, e.Name()))
+		if err != nil {
+			return nil, errors.New("could not read item:" + err.Error())
+		}
+		item := &QueueItem{}
+		err = json.Unmarshal(b, item)
+		if err != nil {
+			log.Error().Err(err).Msgf("dead-lettering unreadable queue item %s", e.Name())
+			_ = os.Rename(filepath.Join(q.dir, e.Name()), filepath.Join(q.dir, deadLetterDir, e.Name()))
+			_ = syncDir(q.dir)
+			_ = syncDir(filepath.Join(q.dir, deadLetterDir))
+			q.mu.Lock()
+			q.size -= e.Size()
+			q.mu.Unlock()
+			continue
+		}
+		item.seq = seq
+		item.size = e.Size()
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].seq < items[j].seq
+	})
+	return items, nil
+}
+
+// Drain delivers the queued items in order with the send function. A delivered item is removed. An item that fails
+// is retried on a later drain, which keeps the order, unless it has failed MaxAttempts times or the failure is not
+// transient, such as a call rejected by the server, in which case it is dead-lettered and draining continues. A send
+// function that fails before a connection is established returns a NotConnectedErr, which is not counted as an
+// attempt. Drain returns the error of the item that stopped it, or nil once the queue is empty.
+func (q *Queue) Drain(send func(item *QueueItem) error) error {
+	return q.drain("", send)
+}
+
+// drain delivers the queued items of the kind, or all items if kind is empty, leaving the others queued.
+func (q *Queue) drain(kind string, send func(item *QueueItem) error) error {
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+	items, err := q.items()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if kind != "" && item.Kind != kind {
+			continue
+		}
+		name := filepath.Join(q.dir, queueFileName(item.seq, item.ID))
+		err := send(item)
+		if err == nil {
+			err = os.Remove(name)
+			if err == nil {
+				err = syncDir(q.dir)
+			}
+			if err != nil {
+				return errors.New("could not remove delivered item:" + err.Error())
+			}
+			q.release(item.size)
+			continue
+		}
+		if _, ok := err.(NotConnectedErr); ok {
+			return err
+		}
+		item.Attempts++
+		item.LastError = err.Error()
+		if item.Attempts >= q.opts.MaxAttempts || !jsonrpc.IsTransient(err) {
+			log.Error().Err(err).Msgf("dead-lettering queue item %s after %d attempts", item.ID, item.Attempts)
+			deadErr := q.deadLetter(item, name)
+			if deadErr != nil {
+				return deadErr
+			}
+			continue
+		}
+		b, encodeErr := json.Marshal(item)
+		if encodeErr == nil {
+			encodeErr = writeFileAtomic(name, b)
+		}
+		if encodeErr != nil {
+			return errors.New("could not update item:" + encodeErr.Error())
+		}
+		q.mu.Lock()
+		q.size += int64(len(b)) - item.size
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// deadLetter moves an item to the dead-letter directory, recording its attempts.
+func (q *Queue) deadLetter(item *QueueItem, name string) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return errors.New("could not encode item:" + err.Error())
+	}
+	err = writeFileAtomic(filepath.Join(q.dir, deadLetterDir, filepath.Base(name)), b)
+	if err != nil {
+		return errors.New("could not dead-letter item:" + err.Error())
+	}
+	err = os.Remove(name)
+	if err == nil {
+		err = syncDir(q.dir)
+	}
+	if err != nil {
+		return errors.New("could not remove dead-lettered item:" + err.Error())
+	}
+	q.release(item.size)
+	return nil
+}
+
+func (q *Queue) release(size int64) {
+	q.mu.Lock()
+	q.size -= size
+	q.mu.Unlock()
+}
+
+// FlushCalls drains the queued calls, sending each as a JSON-RPC request over HTTP with the item's id as the request
+// id. A connection to the host of each call's URL, on port 80 or 443 unless the URL gives one, is opened with the
+// dial function, such as the Dial method of a Dialer with TLS set for https URLs. As the module has a single
+// connection, it is closed before another host is dialled and once the flush is done, and no other connection may
+// be open on the module meanwhile. Queued messages are left for FlushMessages.
+func (q *Queue) FlushCalls(dial func(network, address string) (net.Conn, error)) error {
+	var transport *Transport
+	var address string
+	var dialErr error
+	defer func() {
+		if transport != nil {
+			transport.CloseIdleConnections()
+		}
+	}()
+	return q.drain(QueueItemCall, func(item *QueueItem) error {
+		itemAddress, err := callAddress(item.URL)
+		if err != nil {
+			return &jsonrpc.Error{Message: "invalid call URL: " + err.Error()}
+		}
+		if transport == nil || itemAddress != address {
+			if transport != nil {
+				transport.CloseIdleConnections()
+			}
+			address = itemAddress
+			transport = &Transport{Dial: func() (net.Conn, error) {
+				conn, err := dial("tcp", itemAddress)
+				if err != nil {
+					dialErr = err
+				}
+				return conn, err
+			}}
+		}
+		c := &jsonrpc.Client{
+			URL:        item.URL,
+			HTTPClient: &http.Client{Transport: transport},
+			NewID: func() interface{} {
+				return item.ID
+			},
+		}
+		var params interface{}
+		if len(item.Params) > 0 {
+			params = item.Params
+		}
+		dialErr = nil
+		err = c.Call(context.Background(), item.Method, params, nil)
+		if err != nil && dialErr != nil {
+			return NotConnectedErr{Err: err}
+		}
+		return err
+	})
+}
+
+// callAddress returns the host and port to dial for a call's URL.
+func callAddress(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", errors.New("missing host")
+	}
+	port := u.Port()
+	switch {
+	case port != "":
+	case u.Scheme == "http":
+		port = "80"
+	case u.Scheme == "https":
+		port = "443"
+	default:
+		return "", errors.New("unsupported scheme: " + u.Scheme)
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// FlushMessages drains the queued messages, writing each to the connection as it is. Queued calls are left for
+// FlushCalls, as they are sent over HTTP on connections of their own. It can be used as the OnConnect function of a
+// ReconnectingConn so that the messages are delivered on every reconnection; a failed write means that the
+// connection is broken, so the reconnection is retried. A failed write counts as an attempt, but is always transient.
+func (q *Queue) FlushMessages(conn net.Conn) error {
+	return q.drain(QueueItemMessage, func(item *QueueItem) error {
+		_, err := conn.Write(item.Data)
+		if _, ok := err.(net.Error); err != nil && !ok {
+			err = &net.OpError{Op: "write", Net: "tcp", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+		}
+		return err
+	})
+}
@@ -0,0 +1,215 @@
+package gsmtcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveCalls answers the JSON-RPC calls posted to a local listener, reporting the method of each.
+func serveCalls(t *testing.T, methods chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					var call struct {
+						Method string      `json:"method"`
+						ID     interface{} `json:"id"`
+					}
+					_ = json.NewDecoder(req.Body).Decode(&call)
+					_ = req.Body.Close()
+					methods <- call.Method
+					body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "result": true, "id": call.ID})
+					resp := &http.Response{
+						StatusCode:    http.StatusOK,
+						ProtoMajor:    1,
+						ProtoMinor:    1,
+						Header:        http.Header{"Content-Type": {"application/json"}},
+						ContentLength: int64(len(body)),
+						Body:          ioutil.NopCloser(bytes.NewReader(body)),
+					}
+					if resp.Write(conn) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestQueueFlushCallsDialsEachHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir, QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := make(chan string, 4)
+	first, second := serveCalls(t, methods), serveCalls(t, methods)
+	defer first.Close()
+	defer second.Close()
+	for _, call := range []struct{ addr, method string }{
+		{first.Addr().String(), "First.A"},
+		{first.Addr().String(), "First.B"},
+		{second.Addr().String(), "Second.A"},
+	} {
+		_, err = q.EnqueueCall("http://"+call.addr+"/rpc", call.method, []interface{}{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = q.EnqueueMessage([]byte("raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dialled []string
+	open := 0
+	err = q.FlushCalls(func(network, address string) (net.Conn, error) {
+		if open > 0 {
+			t.Errorf("dialled %s while another connection was open", address)
+		}
+		dialled = append(dialled, address)
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		open++
+		return &countedConn{Conn: conn, open: &open}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dialled) != 2 || dialled[0] != first.Addr().String() || dialled[1] != second.Addr().String() {
+		t.Errorf("expected one dial per host, got %v", dialled)
+	}
+	if open != 0 {
+		t.Errorf("expected the connections to be closed, %d left open", open)
+	}
+	for _, expected := range []string{"First.A", "First.B", "Second.A"} {
+		if method := <-methods; method != expected {
+			t.Errorf("expected %s, got %s", expected, method)
+		}
+	}
+
+	n, err := q.Len()
+	if err != nil || n != 1 {
+		t.Fatalf("expected the message to stay queued, got %d items (%v)", n, err)
+	}
+	client, server := net.Pipe()
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 3)
+		_, _ = server.Read(b)
+		received <- b
+	}()
+	err = q.FlushMessages(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := <-received; string(b) != "raw" {
+		t.Errorf("expected the message to be written, got %q", b)
+	}
+	n, err = q.Len()
+	if err != nil || n != 0 {
+		t.Errorf("expected an empty queue, got %d items (%v)", n, err)
+	}
+}
+
+// countedConn keeps count of the open connections.
+type countedConn struct {
+	net.Conn
+	open   *int
+	closed bool
+}
+
+func (c *countedConn) Close() error {
+	if !c.closed {
+		c.closed = true
+		*c.open--
+	}
+	return c.Conn.Close()
+}
+
+func TestQueueAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir, QueueOptions{MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.EnqueueCall("http://127.0.0.1:1/rpc", "Telemetry.Report", []interface{}{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.EnqueueMessage([]byte("raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// failing to dial while the link is down is not an attempt, however often it happens
+	for i := 0; i < 3; i++ {
+		err = q.FlushCalls(func(network, address string) (net.Conn, error) {
+			return nil, errors.New("link down")
+		})
+		if _, ok := err.(NotConnectedErr); !ok {
+			t.Fatalf("expected a NotConnectedErr, got %v", err)
+		}
+	}
+	items, err := q.items()
+	if err != nil || len(items) != 2 || items[0].Attempts != 0 {
+		t.Fatalf("expected the call to stay queued without attempts, got %+v (%v)", items, err)
+	}
+
+	// a failed write is an attempt, retried until MaxAttempts even though the error is not transient as such
+	client, server := net.Pipe()
+	_ = server.Close()
+	err = q.FlushMessages(client)
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	items, err = q.items()
+	if err != nil || len(items) != 2 || items[1].Attempts != 1 {
+		t.Fatalf("expected the message to stay queued after one attempt, got %+v (%v)", items, err)
+	}
+	err = q.FlushMessages(client)
+	if err != nil {
+		t.Fatalf("expected the message to be dead-lettered, got %v", err)
+	}
+	n, err := q.Len()
+	if err != nil || n != 1 {
+		t.Errorf("expected only the call to stay queued, got %d items (%v)", n, err)
+	}
+	dead, err := ioutil.ReadDir(filepath.Join(dir, deadLetterDir))
+	if err != nil || len(dead) != 1 {
+		t.Errorf("expected one dead-lettered item, got %d (%v)", len(dead), err)
+	}
+}
@@ -0,0 +1,296 @@
+package gsmtcp
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReconnectOptions configures how a ReconnectingConn redials.
+type ReconnectOptions struct {
+	// MinDelay is the delay before the first redial. It defaults to 1 second.
+	MinDelay time.Duration
+	// MaxDelay caps the delay between redials. It defaults to 2 minutes.
+	MaxDelay time.Duration
+	// Multiplier is the factor by which the delay grows after each failed attempt. It defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, by which each delay is randomly shortened so that devices that lost
+	// their connections at the same time do not redial in step.
+	Jitter float64
+	// MaxAttempts limits the number of consecutive failed attempts. Zero means no limit.
+	MaxAttempts int
+	// Reinit re-runs the module's Init before redialling, which recovers a module that has lost network
+	// registration.
+	Reinit bool
+	// Prepare is called before each redial, for example to bring the bearer up again.
+	Prepare func(g *DefaultGsmModule) error
+	// OnConnect is called with each new connection before it is used, so that handshake messages can be replayed.
+	// If it returns an error, the connection is closed and redialled.
+	OnConnect func(conn net.Conn) error
+	// OnDisconnect is called when the connection is found to be closed.
+	OnDisconnect func(err error)
+}
+
+// ReconnectingConn is a long-lived connection that redials with exponential backoff whenever the underlying
+// connection is closed, for example after a cell handover. The connection counts as closed once the module reports
+// CLOSED, NO CARRIER or +PDP: DEACT, which ends a Read with io.EOF, and reads continue on the new connection. A Write is
+// repeated on the new connection only if none of its data had been sent; otherwise its error is returned after
+// reconnecting, as the peer may have received part of it.
+type ReconnectingConn struct {
+	g       *DefaultGsmModule
+	address string
+	opts    ReconnectOptions
+
+	// dialMu serialises redials, while mu guards the fields below
+	dialMu        sync.Mutex
+	mu            sync.Mutex
+	conn          net.Conn
+	closed        bool
+	done          chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// NewReconnectingConn dials the address, retrying as configured, and returns a connection that redials whenever it
+// is lost.
+func NewReconnectingConn(g *DefaultGsmModule, address string, opts ReconnectOptions) (*ReconnectingConn, error) {
+	if opts.MinDelay == 0 {
+		opts.MinDelay = time.Second
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = 2 * time.Minute
+	}
+	if opts.Multiplier < 1 {
+		opts.Multiplier = 2
+	}
+	if opts.Jitter < 0 || opts.Jitter > 1 {
+		return nil, errors.New("jitter must be between 0 and 1")
+	}
+	c := &ReconnectingConn{
+		g:       g,
+		address: address,
+		opts:    opts,
+		done:    make(chan struct{}),
+	}
+	_, err := c.reconnect(nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// backoff returns the delay before the given attempt, counting from zero.
+func (c *ReconnectingConn) backoff(attempt int) time.Duration {
+	delay := float64(c.opts.MinDelay) * math.Pow(c.opts.Multiplier, float64(attempt))
+	if delay > float64(c.opts.MaxDelay) {
+		delay = float64(c.opts.MaxDelay)
+	}
+	delay -= delay * c.opts.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// dial opens and prepares a single new connection.
+func (c *ReconnectingConn) dial() (net.Conn, error) {
+	if c.opts.Reinit {
+		err := c.g.Init()
+		if err != nil {
+			return nil, errors.New("could not initialise module:" + err.Error())
+		}
+	}
+	if c.opts.Prepare != nil {
+		err := c.opts.Prepare(c.g)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := NewConnection(c.g, c.address)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.OnConnect != nil {
+		err = c.opts.OnConnect(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// reconnect replaces the failed connection, unless another caller has already done so. The first attempt is delayed
+// only if wait is set.
+func (c *ReconnectingConn) reconnect(failed net.Conn, cause error, wait bool) (net.Conn, error) {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("connection closed")
+	}
+	if c.conn != failed {
+		conn := c.conn
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.conn = nil
+	c.mu.Unlock()
+	if failed != nil {
+		_ = failed.Close()
+		log.Debug().Err(cause).Msgf("connection to %s lost", c.address)
+		if c.opts.OnDisconnect != nil {
+			c.opts.OnDisconnect(cause)
+		}
+	}
+
+	for attempt := 0; c.opts.MaxAttempts == 0 || attempt < c.opts.MaxAttempts; attempt++ {
+		if wait || attempt > 0 {
+			delay := c.backoff(attempt)
+			log.Debug().Msgf("redialling %s in %v", c.address, delay)
+			select {
+			case <-c.done:
+				return nil, errors.New("connection closed")
+			case <-time.After(delay):
+			}
+		}
+		conn, err := c.dial()
+		if err != nil {
+			log.Debug().Err(err).Msgf("could not connect to %s", c.address)
+			continue
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			_ = conn.Close()
+			return nil, errors.New("connection closed")
+		}
+		_ = conn.SetReadDeadline(c.readDeadline)
+		_ = conn.SetWriteDeadline(c.writeDeadline)
+		c.conn = conn
+		c.mu.Unlock()
+		return conn, nil
+	}
+	return nil, errors.New("could not connect to " + c.address)
+}
+
+// current returns the connection in use.
+func (c *ReconnectingConn) current() (net.Conn, error) {
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, errors.New("connection closed")
+	}
+	if conn == nil {
+		return c.reconnect(nil, nil, true)
+	}
+	return conn, nil
+}
+
+// lost reports whether an error means that the connection has to be redialled. Timeouts leave it in place.
+func lost(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+func (c *ReconnectingConn) Read(b []byte) (int, error) {
+	for {
+		conn, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(b)
+		if n > 0 || err == nil || !lost(err) {
+			return n, err
+		}
+		_, err = c.reconnect(conn, err, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *ReconnectingConn) Write(b []byte) (int, error) {
+	for {
+		conn, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Write(b)
+		if err == nil || !lost(err) {
+			return n, err
+		}
+		_, rerr := c.reconnect(conn, err, true)
+		if rerr != nil {
+			return n, rerr
+		}
+		if n > 0 {
+			return n, err
+		}
+	}
+}
+
+// Close closes the connection and stops any redialling.
+func (c *ReconnectingConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (c *ReconnectingConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return &net.TCPAddr{IP: c.g.localIP}
+	}
+	return c.conn.LocalAddr()
+}
+
+func (c *ReconnectingConn) RemoteAddr() net.Addr {
+	return parseAddr("tcp", c.address)
+}
+
+// SetDeadline sets the read and write deadlines, which also apply to connections dialled later.
+func (c *ReconnectingConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,659 @@
+package gsmtcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NativeTLSOptions configures a connection secured by the module's own SSL/TLS stack. Certificates are referenced
+// by the names they were uploaded under with UploadCertificate.
+type NativeTLSOptions struct {
+	// CACertificate is the CA certificate used to verify the server. The server is not verified if it is empty.
+	CACertificate string
+	// ClientCertificate is the certificate presented to the server for client authentication. On SIM800 modules it
+	// is a PKCS#12 file protected by Password.
+	ClientCertificate string
+	// ClientKey is the private key of the client certificate on SIM7000 and SIM7600 modules.
+	ClientKey string
+	// Password protects the PKCS#12 client certificate on SIM800 modules.
+	Password string
+	// ServerName is sent in the SNI extension on modules that support it.
+	ServerName string
+}
+
+// certificateChunkSize is the largest amount of data written to the module file system at once.
+const certificateChunkSize = 10240
+
+// secureContext is the SSL context and connection identifier used on SIM7000 and SIM7600 modules.
+const secureContext = 0
+
+// NewNativeTLSConnection establishes a connection to the given address that is secured by the module's SSL/TLS
+// stack instead of crypto/tls, so no handshake traffic has to pass through the serial line. The AT commands used
+// depend on the configured Model: AT+CIPSSL on SIM800, the AT+CASSLCFG application stack on SIM7000 and the
+// AT+CSSLCFG/AT+CCH stack on SIM7600.
+func NewNativeTLSConnection(g *DefaultGsmModule, address string, opts NativeTLSOptions) (net.Conn, error) {
+	switch g.model() {
+	case SIM800:
+		err := g.configureSIM800TLS(opts)
+		if err != nil {
+			return nil, err
+		}
+		return openConnection(g, "tcp", address, true)
+	case SIM7000, SIM7600:
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.connOpen {
+			return nil, AlreadyConnectedErr{}
+		}
+		s := &secureSession{g: g, model: g.model(), available: true}
+		err = s.configure(opts, host)
+		if err != nil {
+			return nil, err
+		}
+		_, err = g.GetLocalIPAddress()
+		if err != nil {
+			g.localIP = nil
+			log.Debug().Err(err).Msg("could not determine local IP address")
+		}
+		err = s.open(host, port)
+		if err != nil {
+			return nil, err
+		}
+		g.connOpen = true
+		c := newConn(g, "tcp", address)
+		c.secure = s
+		// the SSL stacks have no TCP keepalive, so the configured period applies to the heartbeat
+		keepAlive := time.Duration(getConfigValue(TCPKeepAliveConfig, g.configs...).(TCPKeepAlive))
+		c.keepAlive.enabled = keepAlive != 0
+		c.keepAlive.period = keepAlive
+		c.keepAlive.fallback = true
+		c.accountConnection()
+		return c, nil
+	default:
+		return nil, fmt.Errorf("native TLS is not supported on %s modules", g.model())
+	}
+}
+
+// SetSSL switches the SSL function of the TCP stack (AT+CIPSSL) on or off. It must be set before a connection is
+// opened.
+func (g *DefaultGsmModule) SetSSL(enabled bool) error {
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(SSLCommand), mode))
+	if err != nil {
+		return errors.New("could not set SSL mode:" + err.Error())
+	}
+	g.ssl = enabled
+	return nil
+}
+
+// UploadCertificate stores a certificate or key in the module's file system under the given name, from where it
+// can be referenced in NativeTLSOptions.
+func (g *DefaultGsmModule) UploadCertificate(name string, data []byte) error {
+	var err error
+	switch g.model() {
+	case SIM800:
+		err = g.uploadSIM800File(name, data)
+	case SIM7000:
+		err = g.uploadSIM7000File(name, data)
+	case SIM7600:
+		err = g.uploadSIM7600Certificate(name, data)
+	default:
+		err = fmt.Errorf("certificates are not supported on %s modules", g.model())
+	}
+	if err != nil {
+		return errors.New("could not upload certificate:" + err.Error())
+	}
+	return nil
+}
+
+func (g *DefaultGsmModule) model() Model {
+	return getConfigValue(ModelConfig, g.configs...).(Model)
+}
+
+// sim800FilePath returns the path of a user file on the SIM800 file system.
+func sim800FilePath(name string) string {
+	return `C:\User\` + name
+}
+
+func (g *DefaultGsmModule) uploadSIM800File(name string, data []byte) error {
+	path := sim800FilePath(name)
+	// the file may already exist, in which case it is overwritten below
+	_ = g.executeATCommand("AT+FSCREATE=" + path)
+	for offset := 0; offset == 0 || offset < len(data); offset += certificateChunkSize {
+		chunk := data[offset:]
+		if len(chunk) > certificateChunkSize {
+			chunk = chunk[:certificateChunkSize]
+		}
+		mode := 1
+		if offset == 0 {
+			mode = 0
+		}
+		err := g.sendCommand(fmt.Sprintf("AT+FSWRITE=%s,%d,%d,%d", path, mode, len(chunk), 10))
+		if err != nil {
+			return err
+		}
+		err = g.waitForPrompt(5 * time.Second)
+		if err != nil {
+			return err
+		}
+		err = g.writeConfirmed(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *DefaultGsmModule) uploadSIM7000File(name string, data []byte) error {
+	err := g.executeATCommand("AT+CFSINIT")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := g.executeATCommand("AT+CFSTERM")
+		if err != nil {
+			log.Error().Err(err).Msg("could not release file system buffer")
+		}
+	}()
+	for offset := 0; offset == 0 || offset < len(data); offset += certificateChunkSize {
+		chunk := data[offset:]
+		if len(chunk) > certificateChunkSize {
+			chunk = chunk[:certificateChunkSize]
+		}
+		mode := 1
+		if offset == 0 {
+			mode = 0
+		}
+		// directory 3 is /customer/, where the SSL configuration looks for certificates
+		err = g.sendCommand(fmt.Sprintf(`AT+CFSWFILE=3,"%s",%d,%d,%d`, name, mode, len(chunk), 10000))
+		if err != nil {
+			return err
+		}
+		_, err = g.waitForLine(regexp.MustCompile("^DOWNLOAD$"), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		err = g.writeConfirmed(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *DefaultGsmModule) uploadSIM7600Certificate(name string, data []byte) error {
+	err := g.sendCommand(fmt.Sprintf(`AT+CCERTDOWN="%s",%d`, name, len(data)))
+	if err != nil {
+		return err
+	}
+	err = g.waitForPrompt(5 * time.Second)
+	if err != nil {
+		return err
+	}
+	return g.writeConfirmed(data)
+}
+
+// writeConfirmed writes data requested by the module's input prompt, and waits for it to be accepted.
+func (g *DefaultGsmModule) writeConfirmed(data []byte) error {
+	_, err := g.sp.Write(data)
+	if err != nil {
+		return err
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf("^(%s|%s)$",
+		string(OkResponse),
+		string(ErrorResponse))), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if m != string(OkResponse) {
+		return errors.New(m)
+	}
+	return nil
+}
+
+func (g *DefaultGsmModule) configureSIM800TLS(opts NativeTLSOptions) error {
+	// SSL option 0 ignores invalid server certificates, option 1 enables client authentication
+	ignoreInvalid := 1
+	if opts.CACertificate != "" {
+		err := g.setSIM800Certificate(opts.CACertificate, "")
+		if err != nil {
+			return err
+		}
+		ignoreInvalid = 0
+	}
+	err := g.executeATCommand(fmt.Sprintf("AT+SSLOPT=0,%d", ignoreInvalid))
+	if err != nil {
+		return errors.New("could not configure server verification:" + err.Error())
+	}
+	clientAuth := 0
+	if opts.ClientCertificate != "" {
+		err := g.setSIM800Certificate(opts.ClientCertificate, opts.Password)
+		if err != nil {
+			return err
+		}
+		clientAuth = 1
+	}
+	err = g.executeATCommand(fmt.Sprintf("AT+SSLOPT=1,%d", clientAuth))
+	if err != nil {
+		return errors.New("could not configure client authentication:" + err.Error())
+	}
+	return nil
+}
+
+var setCertificateRegexp = regexp.MustCompile(`^\+SSLSETCERT: ([0-9]+)$`)
+
+func (g *DefaultGsmModule) setSIM800Certificate(name string, password string) error {
+	cmd := fmt.Sprintf(`AT+SSLSETCERT="%s"`, sim800FilePath(name))
+	if password != "" {
+		cmd += fmt.Sprintf(`,"%s"`, password)
+	}
+	err := g.sendCommand(cmd)
+	if err != nil {
+		return errors.New("could not set certificate:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(\+SSLSETCERT: [0-9]+|%s)$`,
+		string(ErrorResponse))), 10*time.Second)
+	if err != nil {
+		return errors.New("could not set certificate:" + err.Error())
+	}
+	s := setCertificateRegexp.FindStringSubmatch(m)
+	if s == nil || s[1] != "0" {
+		return errors.New("could not set certificate " + name + ": " + m)
+	}
+	return nil
+}
+
+// secureSession is a connection on the SSL application stacks of SIM7000 (AT+CA) and SIM7600 (AT+CCH) modules,
+// which hold received data until it is retrieved explicitly.
+type secureSession struct {
+	g     *DefaultGsmModule
+	model Model
+	// closed is set once the connection has been closed locally, and peerClosed once the module has reported that
+	// the peer closed it, after which the data still held by the module can be retrieved
+	closed     bool
+	peerClosed bool
+	// available is set once the module notifies that it holds received data
+	available   bool
+	lastReceive time.Time
+}
+
+func (s *secureSession) configure(opts NativeTLSOptions, host string) error {
+	var cmds []string
+	serverName := opts.ServerName
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	switch s.model {
+	case SIM7000:
+		cmds = append(cmds, fmt.Sprintf(`AT+CSSLCFG="sslversion",%d,3`, secureContext))
+		if opts.CACertificate != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CSSLCFG="convert",2,"%s"`, opts.CACertificate))
+		}
+		if opts.ClientCertificate != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CSSLCFG="convert",1,"%s","%s"`,
+				opts.ClientCertificate, opts.ClientKey))
+		}
+		if serverName != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CSSLCFG="sni",%d,"%s"`, secureContext, serverName))
+		}
+		cmds = append(cmds,
+			fmt.Sprintf(`AT+CASSLCFG=%d,"ssl",1`, secureContext),
+			fmt.Sprintf(`AT+CASSLCFG=%d,"crindex",%d`, secureContext, secureContext))
+		if opts.CACertificate != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CASSLCFG=%d,"cacert","%s"`, secureContext, opts.CACertificate))
+		}
+		if opts.ClientCertificate != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CASSLCFG=%d,"clientcert","%s"`,
+				secureContext, opts.ClientCertificate))
+		}
+	case SIM7600:
+		// authentication modes: 0 none, 1 server, 2 server and client, 3 client
+		authMode := 0
+		switch {
+		case opts.CACertificate != "" && opts.ClientCertificate != "":
+			authMode = 2
+		case opts.CACertificate != "":
+			authMode = 1
+		case opts.ClientCertificate != "":
+			authMode = 3
+		}
+		cmds = append(cmds,
+			fmt.Sprintf(`AT+CSSLCFG="sslversion",%d,4`, secureContext),
+			fmt.Sprintf(`AT+CSSLCFG="authmode",%d,%d`, secureContext, authMode))
+		if opts.CACertificate != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CSSLCFG="cacert",%d,"%s"`, secureContext, opts.CACertificate))
+		}
+		if opts.ClientCertificate != "" {
+			cmds = append(cmds,
+				fmt.Sprintf(`AT+CSSLCFG="clientcert",%d,"%s"`, secureContext, opts.ClientCertificate),
+				fmt.Sprintf(`AT+CSSLCFG="clientkey",%d,"%s"`, secureContext, opts.ClientKey))
+		}
+		if serverName != "" {
+			cmds = append(cmds, fmt.Sprintf(`AT+CSSLCFG="enableSNI",%d,1`, secureContext))
+		}
+		// no send result reports, and manual receive mode
+		cmds = append(cmds, "AT+CCHSET=0,1")
+	}
+	for _, cmd := range cmds {
+		err := s.g.executeATCommand(cmd)
+		if err != nil {
+			return errors.New("could not configure SSL:" + err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *secureSession) open(host string, port string) error {
+	switch s.model {
+	case SIM7000:
+		err := s.g.activateApplicationNetwork()
+		if err != nil {
+			return err
+		}
+		err = s.g.sendCommand(fmt.Sprintf(`AT+CAOPEN=%d,"%s",%s`, secureContext, host, port))
+		if err != nil {
+			return errors.New("could not open connection:" + err.Error())
+		}
+		return s.waitForResult(`+CAOPEN: 0`, 60*time.Second)
+	case SIM7600:
+		err := s.g.sendCommand("AT+CCHSTART")
+		if err != nil {
+			return errors.New("could not start SSL service:" + err.Error())
+		}
+		err = s.waitForResult(`+CCHSTART`, 10*time.Second)
+		if err != nil {
+			// the service may already have been started by a previous connection
+			log.Debug().Err(err).Msg("could not start SSL service")
+		}
+		err = s.g.executeATCommand(fmt.Sprintf("AT+CCHSSLCFG=%d,%d", secureContext, secureContext))
+		if err != nil {
+			return errors.New("could not set SSL context:" + err.Error())
+		}
+		// client type 2 is an SSL/TLS client
+		err = s.g.sendCommand(fmt.Sprintf(`AT+CCHOPEN=%d,"%s",%s,2`, secureContext, host, port))
+		if err != nil {
+			return errors.New("could not open connection:" + err.Error())
+		}
+		return s.waitForResult(`+CCHOPEN: 0`, 60*time.Second)
+	}
+	return nil
+}
+
+// waitForResult waits for a "<prefix>,<result>" or "<prefix>: <result>" response and checks that the result code
+// indicates success.
+func (s *secureSession) waitForResult(prefix string, timeout time.Duration) error {
+	m, err := s.g.waitForLine(regexp.MustCompile(fmt.Sprintf(`^(%s[:,] ?[0-9]+|%s)$`,
+		regexp.QuoteMeta(prefix),
+		string(ErrorResponse))), timeout)
+	if err != nil {
+		return err
+	}
+	if m == string(ErrorResponse) {
+		return errors.New(m)
+	}
+	if result := m[len(prefix)+1:]; strings.TrimSpace(result) != "0" {
+		return errors.New(m)
+	}
+	return nil
+}
+
+var applicationNetworkRegexp = regexp.MustCompile(`^\+CNACT: ([0-9]),`)
+
+// activateApplicationNetwork brings up the PDP context used by the application stack of SIM7000 modules.
+func (g *DefaultGsmModule) activateApplicationNetwork() error {
+	err := g.sendCommand("AT+CNACT?")
+	if err != nil {
+		return errors.New("could not query application network:" + err.Error())
+	}
+	m, err := g.waitForLine(applicationNetworkRegexp, 5*time.Second)
+	if err != nil {
+		return errors.New("could not query application network:" + err.Error())
+	}
+	if applicationNetworkRegexp.FindStringSubmatch(m)[1] == "1" {
+		return nil
+	}
+	apn := getConfigValue(APNConfig, g.configs...).(APN)
+	err = g.executeATCommand(fmt.Sprintf(`AT+CNACT=1,"%s"`, apn))
+	if err != nil {
+		return errors.New("could not activate application network:" + err.Error())
+	}
+	_, err = g.waitForLine(regexp.MustCompile(`^\+APP PDP: ACTIVE$`), 30*time.Second)
+	if err != nil {
+		return errors.New("could not activate application network:" + err.Error())
+	}
+	return nil
+}
+
+func (s *secureSession) write(b []byte) (int, error) {
+	if s.closed {
+		return 0, ClosedErr{}
+	}
+	if s.peerClosed {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > maxReceiveLength {
+			chunk = chunk[:maxReceiveLength]
+		}
+		cmd := fmt.Sprintf("AT+CASEND=%d,%d", secureContext, len(chunk))
+		if s.model == SIM7600 {
+			cmd = fmt.Sprintf("AT+CCHSEND=%d,%d", secureContext, len(chunk))
+		}
+		err := s.g.sendCommand(cmd)
+		if err != nil {
+			return written, err
+		}
+		err = s.g.waitForPrompt(5 * time.Second)
+		if err == nil {
+			err = s.g.writeConfirmed(chunk)
+		}
+		if err != nil {
+			return written, errors.New("could not send data:" + err.Error())
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// poll retrieves the data held by the module. If the module has not notified that data has arrived, it waits for
+// the notification no longer than the given time; as the notification may have been consumed by another exchange,
+// the module is asked anyway once a second.
+func (s *secureSession) poll(b []byte, wait time.Duration) (int, error) {
+	if s.closed {
+		return 0, ClosedErr{}
+	}
+	if !s.available && !s.peerClosed && time.Since(s.lastReceive) < time.Second {
+		err := s.waitForData(wait)
+		if _, ok := err.(TimedOutErr); ok {
+			return 0, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	s.lastReceive = time.Now()
+	data, err := s.receive(len(b))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		s.available = false
+		return 0, nil
+	}
+	return copy(b, data), nil
+}
+
+var caReceiveRegexp = regexp.MustCompile(`^\+CARECV: ([0-9]+)$`)
+var cchReceiveRegexp = regexp.MustCompile(`^\+CCHRECV: DATA,0,([0-9]+)$`)
+var cchReceiveDoneRegexp = regexp.MustCompile(`^\+CCHRECV: 0,[0-9]+$`)
+
+// receive retrieves up to max bytes of the data held by the module.
+func (s *secureSession) receive(max int) ([]byte, error) {
+	if max > maxReceiveLength {
+		max = maxReceiveLength
+	}
+	switch s.model {
+	case SIM7000:
+		err := s.g.sendCommand(fmt.Sprintf("AT+CARECV=%d,%d", secureContext, max))
+		if err != nil {
+			return nil, errors.New("could not receive data:" + err.Error())
+		}
+		for {
+			// the data follows the length on the same line
+			token, delim, err := s.g.readUntil(",\n", 5*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			if delim == ',' && !caReceiveRegexp.MatchString(token) {
+				rest, _, err := s.g.readUntil("\n", 5*time.Second)
+				if err != nil {
+					return nil, err
+				}
+				token += "," + rest
+			}
+			if s.handleNotification(token) {
+				continue
+			}
+			if token == string(ErrorResponse) {
+				return nil, errors.New("could not receive data")
+			}
+			m := caReceiveRegexp.FindStringSubmatch(token)
+			if m == nil {
+				continue
+			}
+			n, err := strconv.Atoi(m[1])
+			if err != nil {
+				return nil, err
+			}
+			data, err := s.g.readBytes(n, 5*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			_, err = s.g.waitForLine(okRegexp, 5*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) == 0 {
+				return nil, s.closedErr()
+			}
+			return data, nil
+		}
+	case SIM7600:
+		err := s.g.sendCommand(fmt.Sprintf("AT+CCHRECV=%d,%d", secureContext, max))
+		if err != nil {
+			return nil, errors.New("could not receive data:" + err.Error())
+		}
+		var data []byte
+		for {
+			line, err := s.g.readLine(5 * time.Second)
+			if err != nil {
+				return nil, err
+			}
+			if s.handleNotification(line) {
+				continue
+			}
+			if line == string(ErrorResponse) {
+				return nil, errors.New("could not receive data")
+			}
+			if cchReceiveDoneRegexp.MatchString(line) {
+				if len(data) == 0 {
+					return nil, s.closedErr()
+				}
+				return data, nil
+			}
+			m := cchReceiveRegexp.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			n, err := strconv.Atoi(m[1])
+			if err != nil {
+				return nil, err
+			}
+			d, err := s.g.readBytes(n, 5*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, d...)
+		}
+	}
+	return nil, nil
+}
+
+// closedErr returns io.EOF once the peer has closed the connection.
+func (s *secureSession) closedErr() error {
+	if s.peerClosed {
+		return io.EOF
+	}
+	return nil
+}
+
+// handleNotification processes the unsolicited result codes of the SSL stacks, reporting whether the line was one.
+func (s *secureSession) handleNotification(line string) bool {
+	switch line {
+	case "+CADATAIND: 0", "+CCHEVENT: 0,RECV EVENT":
+		s.available = true
+		return true
+	case "+CASTATE: 0,0", "+CCH_PEER_CLOSED: 0", "+CCHCLOSE: 0,0":
+		s.peerClosed = true
+		return true
+	}
+	return false
+}
+
+// waitForData waits for the module to notify that new data has been received.
+func (s *secureSession) waitForData(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		line, err := s.g.readLine(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if s.handleNotification(line) {
+			if s.peerClosed {
+				return io.EOF
+			}
+			return nil
+		}
+	}
+}
+
+func (s *secureSession) close() error {
+	switch s.model {
+	case SIM7000:
+		err := s.g.executeATCommand(fmt.Sprintf("AT+CACLOSE=%d", secureContext))
+		if err != nil && !s.peerClosed {
+			return errors.New("could not close connection:" + err.Error())
+		}
+	case SIM7600:
+		err := s.g.sendCommand(fmt.Sprintf("AT+CCHCLOSE=%d", secureContext))
+		if err == nil {
+			// once the peer has closed the connection, the module answers with an error
+			err = s.waitForResult(`+CCHCLOSE: 0`, 10*time.Second)
+		}
+		if err != nil && !s.peerClosed {
+			return errors.New("could not close connection:" + err.Error())
+		}
+		err = s.g.executeATCommand("AT+CCHSTOP")
+		if err != nil {
+			log.Error().Err(err).Msg("could not stop SSL service")
+		}
+	}
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,137 @@
+package gsmtcp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUploadCertificate(t *testing.T) {
+	// larger than a chunk, so that the file is written in parts where the module needs it
+	data := bytes.Repeat([]byte("0123456789abcdef"), certificateChunkSize/16+100)
+	for _, test := range []struct {
+		model Model
+		file  string
+	}{
+		{SIM800, `C:\User\ca.pem`},
+		{SIM7000, "ca.pem"},
+		{SIM7600, "ca.pem"},
+	} {
+		modem := newFakeModem()
+		g := &DefaultGsmModule{sp: modem, configs: []Config{test.model}, usage: newUsageMeter("", 1)}
+		err := g.UploadCertificate("ca.pem", data)
+		if err != nil {
+			t.Errorf("%s: %v", test.model, err)
+		}
+		modem.mu.Lock()
+		stored := modem.files[test.file]
+		modem.mu.Unlock()
+		if !bytes.Equal(stored, data) {
+			t.Errorf("%s: stored %d bytes in %s, want %d", test.model, len(stored), test.file, len(data))
+		}
+		_ = modem.Close()
+	}
+}
+
+// dialNativeTLS opens a native TLS connection on a fake modem of the model to a local listener.
+func dialNativeTLS(t *testing.T, model Model) (net.Conn, net.Conn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modem := newFakeModem()
+	g := &DefaultGsmModule{sp: modem, configs: []Config{model}, usage: newUsageMeter("", 1)}
+	c, err := NewNativeTLSConnection(g, ln.Addr().String(), NativeTLSOptions{CACertificate: "ca.pem"})
+	if err != nil {
+		_ = ln.Close()
+		_ = modem.Close()
+		t.Fatalf("%s: %v", model, err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, peer, func() {
+		_ = c.Close()
+		_ = peer.Close()
+		_ = ln.Close()
+		_ = modem.Close()
+	}
+}
+
+func TestNativeTLSConnection(t *testing.T) {
+	for _, model := range []Model{SIM800, SIM7000, SIM7600} {
+		c, peer, stop := dialNativeTLS(t, model)
+		if ip := c.LocalAddr().(*net.TCPAddr).IP.String(); ip != "10.0.0.2" {
+			t.Errorf("%s: local address %s, want 10.0.0.2", model, ip)
+		}
+		_, err := c.Write([]byte("hello"))
+		if err != nil {
+			t.Fatalf("%s: %v", model, err)
+		}
+		b := make([]byte, 5)
+		_, err = io.ReadFull(peer, b)
+		if err != nil || string(b) != "hello" {
+			t.Errorf("%s: peer read %q, %v", model, b, err)
+		}
+		_, err = peer.Write([]byte("world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.ReadFull(c, b)
+		if err != nil || string(b) != "world" {
+			t.Errorf("%s: read %q, %v", model, b, err)
+		}
+		err = c.Close()
+		if err != nil {
+			t.Errorf("%s: close: %v", model, err)
+		}
+		_, err = c.Write([]byte("closed"))
+		if err == nil {
+			t.Errorf("%s: write after close: got no error", model)
+		}
+		stop()
+	}
+}
+
+func TestNativeTLSPeerClose(t *testing.T) {
+	for _, model := range []Model{SIM7000, SIM7600} {
+		c, peer, stop := dialNativeTLS(t, model)
+		_, err := peer.Write([]byte("bye"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = peer.Close()
+		_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		b, err := ioutil.ReadAll(c)
+		if err != nil || string(b) != "bye" {
+			t.Errorf("%s: read %q, %v, want the data before EOF", model, b, err)
+		}
+		_, err = c.Write([]byte("late"))
+		if err == nil {
+			t.Errorf("%s: write after peer close: got no error", model)
+		}
+		err = c.Close()
+		if err != nil {
+			t.Errorf("%s: close after peer close: %v", model, err)
+		}
+		// the module is free for the next connection
+		g := c.(*Conn).g
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := NewNativeTLSConnection(g, ln.Addr().String(), NativeTLSOptions{})
+		if err != nil {
+			t.Errorf("%s: connection after peer close: %v", model, err)
+		} else {
+			_ = next.Close()
+		}
+		_ = ln.Close()
+		stop()
+	}
+}
@@ -0,0 +1,205 @@
+package gsmtcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"regexp"
+	"time"
+)
+
+// closeNoticeWait is how long to wait for the rest of a possible close notice at the end of the data.
+const closeNoticeWait = 20 * time.Millisecond
+
+// escapeGuardTime is the period of silence required on the serial line before and after the escape sequence.
+const escapeGuardTime = 1 * time.Second
+
+// EscapeSequence switches the module from data mode back to command mode.
+const EscapeSequence = "+++"
+
+// closeNotices are the lines with which the module leaves data mode when the peer closes the connection.
+var closeNotices = [][]byte{
+	[]byte("\r\n" + string(ClosedResponse) + "\r\n"),
+	[]byte("\r\n" + string(NoCarrierResponse) + "\r\n"),
+}
+
+var closeNoticeRegexp = regexp.MustCompile(fmt.Sprintf("^(%s|%s|%s)$",
+	string(OkResponse),
+	string(ClosedResponse),
+	string(NoCarrierResponse)))
+
+// trimCloseNotice removes a close notice from the end of the data read in data mode, reporting whether there was
+// one.
+func trimCloseNotice(data []byte) ([]byte, bool) {
+	for _, notice := range closeNotices {
+		if bytes.HasSuffix(data, notice) {
+			return data[:len(data)-len(notice)], true
+		}
+	}
+	return data, false
+}
+
+// endsWithPartialCloseNotice reports whether the data ends with the beginning of a close notice, in which case more
+// must be read before it can be told apart from payload.
+func endsWithPartialCloseNotice(data []byte) bool {
+	for _, notice := range closeNotices {
+		for i := len(notice) - 1; i > 0; i-- {
+			if bytes.HasSuffix(data, notice[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetTransparentMode switches transparent mode (AT+CIPMODE) on or off. It must be set before a connection is opened.
+func (g *DefaultGsmModule) SetTransparentMode(enabled bool) error {
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	err := g.executeATCommand(fmt.Sprintf(string(TransparentModeCommand), mode))
+	if err != nil {
+		return errors.New("could not set transparent mode:" + err.Error())
+	}
+	g.transparent = enabled
+	return nil
+}
+
+// InDataMode reports whether the serial line is currently connected to the remote end in transparent mode.
+func (g *DefaultGsmModule) InDataMode() bool {
+	return g.dataMode
+}
+
+// EnterCommandMode sends the guard-timed escape sequence, switching the module from data mode to command mode
+// while keeping the connection open.
+func (g *DefaultGsmModule) EnterCommandMode() error {
+	if !g.dataMode {
+		return nil
+	}
+	// no data may be sent during the guard time before the escape sequence
+	if wait := escapeGuardTime - time.Since(g.lastDataTime); wait > 0 {
+		time.Sleep(wait)
+	}
+	_, err := g.sp.Write([]byte(EscapeSequence))
+	if err != nil {
+		return errors.New("could not send escape sequence:" + err.Error())
+	}
+	g.lastDataTime = time.Now()
+	// the module only answers once the guard time after the escape sequence has passed
+	log.Debug().Msg("waiting for OK")
+	m, err := g.waitForLine(closeNoticeRegexp, escapeGuardTime+2*time.Second)
+	if err != nil {
+		return errors.New("could not enter command mode:" + err.Error())
+	}
+	g.dataMode = false
+	if m != string(OkResponse) {
+		// the peer closed the connection before the escape sequence was seen
+		g.peerClosed = true
+	}
+	return nil
+}
+
+// ResumeDataMode switches the module from command mode back to data mode (ATO) on the open connection.
+func (g *DefaultGsmModule) ResumeDataMode() error {
+	if g.dataMode {
+		return nil
+	}
+	err := g.sendCommand(string(ResumeDataModeCommand))
+	if err != nil {
+		return errors.New("could not resume data mode:" + err.Error())
+	}
+	m, err := g.waitForLine(regexp.MustCompile(fmt.Sprintf("^(%s|%s|%s)$",
+		string(ConnectResponse),
+		string(NoCarrierResponse),
+		string(ErrorResponse))), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if m == string(NoCarrierResponse) {
+		g.peerClosed = true
+		return io.EOF
+	}
+	if m != string(ConnectResponse) {
+		return errors.New("could not resume data mode:" + m)
+	}
+	g.dataMode = true
+	g.lastDataTime = time.Now()
+	return nil
+}
+
+// writeTransparentData writes raw data to the connection in data mode.
+func (g *DefaultGsmModule) writeTransparentData(data []byte) (int, error) {
+	if g.peerClosed {
+		return 0, io.EOF
+	}
+	err := g.ResumeDataMode()
+	if err != nil {
+		return 0, err
+	}
+	n, err := g.sp.Write(data)
+	g.lastDataTime = time.Now()
+	return n, err
+}
+
+// readTransparentData reads the raw data available on the serial line in data mode, waiting until at least one
+// byte has been received. When the peer closes the connection, the module leaves data mode with a close notice,
+// which is removed from the data; io.EOF is returned once the data before it has been read.
+func (g *DefaultGsmModule) readTransparentData(b []byte, deadline time.Time) (int, error) {
+	if len(g.pending) > 0 {
+		n := copy(b, g.pending)
+		g.pending = g.pending[n:]
+		return n, nil
+	}
+	if g.peerClosed {
+		return 0, io.EOF
+	}
+	err := g.ResumeDataMode()
+	if err != nil {
+		return 0, err
+	}
+	var data []byte
+	var partialSince time.Time
+	for {
+		d, err := g.sp.Read()
+		if err == io.EOF {
+			if len(data) > 0 && !endsWithPartialCloseNotice(data) {
+				break
+			}
+			if len(data) > 0 {
+				// wait briefly for the rest of what may be a close notice
+				if partialSince.IsZero() {
+					partialSince = time.Now()
+				} else if time.Since(partialSince) > closeNoticeWait {
+					break
+				}
+			} else if !deadline.IsZero() && time.Now().After(deadline) {
+				return 0, TimedOutErr{}
+			}
+			time.Sleep(serialPollInterval)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		data = append(data, d)
+		partialSince = time.Time{}
+		if len(data) >= len(b) && !endsWithPartialCloseNotice(data) {
+			break
+		}
+	}
+	data, closed := trimCloseNotice(data)
+	if closed {
+		log.Debug().Msg("connection closed by peer")
+		g.dataMode = false
+		g.peerClosed = true
+		if len(data) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, data)
+	g.pending = data[n:]
+	return n, nil
+}
@@ -0,0 +1,170 @@
+package gsmtcp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Transport is an HTTP/1.1 http.RoundTripper over a single established connection, such as a TLS connection made
+// through the GSM module. Responses are parsed from the stream as they arrive, with Content-Length or chunked
+// bodies. Requests are sent one at a time, and the connection is kept open for the next request until either side
+// asks to close it. A request waits until the body of the previous response has been read to the end or closed.
+//
+// A Transport holds the state of its connection, so it must be used by pointer, as in &Transport{Conn: conn}.
+type Transport struct {
+	Conn net.Conn
+	// Dial opens a new connection after Conn has been closed. If it is nil, requests fail once the connection has
+	// been closed.
+	Dial func() (net.Conn, error)
+
+	mu         sync.Mutex
+	reader     *bufio.Reader
+	readerConn net.Conn
+	closed     bool
+}
+
+// connection returns the connection for the next request, redialling if it has been closed.
+func (t *Transport) connection() (net.Conn, error) {
+	if t.Conn == nil || t.closed {
+		if t.Dial == nil {
+			return nil, errors.New("connection closed")
+		}
+		conn, err := t.Dial()
+		if err != nil {
+			return nil, errors.New("could not dial:" + err.Error())
+		}
+		t.Conn = conn
+		t.closed = false
+	}
+	if t.readerConn != t.Conn {
+		t.reader = bufio.NewReader(t.Conn)
+		t.readerConn = t.Conn
+	}
+	return t.Conn, nil
+}
+
+// closeConn closes the connection so that it is not reused.
+func (t *Transport) closeConn() {
+	if t.Conn != nil && !t.closed {
+		_ = t.Conn.Close()
+	}
+	t.closed = true
+}
+
+// CloseIdleConnections closes the connection once the body of the previous response has been consumed. The next
+// request opens a new connection with Dial. It is called by http.Client.CloseIdleConnections.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	t.closeConn()
+	t.mu.Unlock()
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	conn, err := t.connection()
+	if err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	deadline, hasDeadline := req.Context().Deadline()
+	if hasDeadline {
+		_ = conn.SetDeadline(deadline)
+	}
+	fail := func(err error) (*http.Response, error) {
+		t.closeConn()
+		t.mu.Unlock()
+		return nil, err
+	}
+
+	// buffer the request, as every write to the module is a separate send
+	w := bufio.NewWriterSize(conn, maxReceiveLength)
+	err = req.Write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	var resp *http.Response
+	for {
+		resp, err = http.ReadResponse(t.reader, req)
+		if err != nil {
+			return fail(err)
+		}
+		// skip informational responses such as 100 Continue
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+	}
+	resp.Body = &transportBody{
+		body:        resp.Body,
+		t:           t,
+		conn:        conn,
+		close:       resp.Close || req.Close,
+		hasDeadline: hasDeadline,
+	}
+	return resp, nil
+}
+
+// maxDrain is the largest remainder of a response body that is read and discarded on Close so that the connection
+// can be kept open. Decoders such as json.Decoder stop at the end of the value, before a trailing newline or the
+// end of a chunked body; larger remainders are not worth the traffic, and the connection is closed instead.
+const maxDrain = 4 << 10
+
+// transportBody releases the connection to the next request once the response body has been consumed.
+type transportBody struct {
+	body        io.ReadCloser
+	t           *Transport
+	conn        net.Conn
+	close       bool
+	hasDeadline bool
+	once        sync.Once
+	// done is set once a read has returned an error, which releases the connection
+	done bool
+}
+
+func (b *transportBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.done = true
+		b.release(true)
+	} else if err != nil {
+		b.done = true
+		b.release(false)
+	}
+	return n, err
+}
+
+func (b *transportBody) Close() error {
+	if !b.done {
+		// a body that was not read to the end leaves the connection mid-response, unless the rest can be drained
+		complete := b.body == http.NoBody
+		if !complete && !b.close {
+			n, err := io.CopyN(ioutil.Discard, b.body, maxDrain+1)
+			complete = err == io.EOF && n <= maxDrain
+		}
+		b.done = true
+		b.release(complete)
+	}
+	return b.body.Close()
+}
+
+// release unlocks the transport, closing the connection unless the response was complete and may be followed by
+// another.
+func (b *transportBody) release(complete bool) {
+	b.once.Do(func() {
+		if b.hasDeadline {
+			_ = b.conn.SetDeadline(time.Time{})
+		}
+		if b.close || !complete {
+			b.t.closeConn()
+		}
+		b.t.mu.Unlock()
+	})
+}
@@ -0,0 +1,60 @@
+package gsmtcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// serveJSON answers each request on the connection with a chunked JSON body that ends in a newline.
+func serveJSON(conn net.Conn, replies int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; i < replies; i++ {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		_ = req.Body.Close()
+		body := fmt.Sprintf("{\"n\":%d}\n", i)
+		_, err = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n",
+			len(body), body)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestTransportKeepsConnectionAfterDecoding(t *testing.T) {
+	client, server := net.Pipe()
+	go serveJSON(server, 2)
+	transport := &Transport{
+		Conn: client,
+		Dial: func() (net.Conn, error) {
+			return nil, errors.New("connection was not kept open")
+		},
+	}
+	c := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := c.Post("http://device/rpc", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		var reply struct {
+			N int `json:"n"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&reply)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if reply.N != i {
+			t.Fatalf("request %d: got reply %d", i, reply.N)
+		}
+	}
+}
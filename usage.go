@@ -0,0 +1,255 @@
+package gsmtcp
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// tcpHeaderSize is the size of the IPv4 and TCP headers carried by every segment.
+const tcpHeaderSize = 40
+
+// tcpSegmentSize is the typical maximum payload of a segment on a GPRS link.
+const tcpSegmentSize = 1460
+
+// tcpConnectionOverhead estimates the handshake and teardown segments of a connection.
+const tcpConnectionOverhead = 7 * tcpHeaderSize
+
+// usageSaveInterval limits how often the usage file is rewritten while data is flowing.
+const usageSaveInterval = time.Minute
+
+// Usage describes the traffic of a module within the current billing cycle.
+type Usage struct {
+	// PayloadIn is the number of payload bytes received.
+	PayloadIn int64 `json:"payloadIn"`
+	// PayloadOut is the number of payload bytes sent.
+	PayloadOut int64 `json:"payloadOut"`
+	// ProtocolOverhead estimates the TCP/IP headers, acknowledgements and handshakes sent and received along
+	// with the payload.
+	ProtocolOverhead int64 `json:"protocolOverhead"`
+	// CommandOverhead is the number of AT command bytes written to the module. These are exchanged on the serial
+	// line only, and are not billed.
+	CommandOverhead int64 `json:"commandOverhead"`
+	// Since is the start of the billing cycle.
+	Since time.Time `json:"since"`
+}
+
+// Total estimates the number of bytes billed for the billing cycle.
+func (u Usage) Total() int64 {
+	return u.PayloadIn + u.PayloadOut + u.ProtocolOverhead
+}
+
+// ConnUsage describes the traffic of a single connection.
+type ConnUsage struct {
+	PayloadIn        int64
+	PayloadOut       int64
+	ProtocolOverhead int64
+}
+
+type usageThreshold struct {
+	threshold int64
+	hook      func(Usage)
+	fired     bool
+}
+
+// usageMeter accumulates the traffic of a module, persisting it to a file if one is configured.
+type usageMeter struct {
+	sync.Mutex
+	usage      Usage
+	file       string
+	cycleDay   int
+	thresholds []*usageThreshold
+	lastSave   time.Time
+}
+
+func newUsageMeter(file string, cycleDay int) *usageMeter {
+	m := &usageMeter{
+		file:     file,
+		cycleDay: cycleDay,
+	}
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(content, &m.usage)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Msgf("could not load usage from %s", file)
+			m.usage = Usage{}
+		}
+	}
+	m.resetExpiredCycle(time.Now())
+	return m
+}
+
+// cycleStart determines the start of the billing cycle that the given time falls in.
+func cycleStart(t time.Time, day int) time.Time {
+	start := time.Date(t.Year(), t.Month(), day, 0, 0, 0, 0, t.Location())
+	if start.After(t) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// resetExpiredCycle clears the usage once a new billing cycle has started.
+func (m *usageMeter) resetExpiredCycle(now time.Time) {
+	start := cycleStart(now, m.cycleDay)
+	if m.usage.Since.Before(start) {
+		m.usage = Usage{Since: start}
+		for _, t := range m.thresholds {
+			t.fired = false
+		}
+	}
+}
+
+// add records traffic, fires the hooks of any thresholds crossed and saves the usage periodically.
+func (m *usageMeter) add(delta Usage) {
+	m.Lock()
+	now := time.Now()
+	m.resetExpiredCycle(now)
+	m.usage.PayloadIn += delta.PayloadIn
+	m.usage.PayloadOut += delta.PayloadOut
+	m.usage.ProtocolOverhead += delta.ProtocolOverhead
+	m.usage.CommandOverhead += delta.CommandOverhead
+	usage := m.usage
+	var hooks []func(Usage)
+	for _, t := range m.thresholds {
+		if !t.fired && usage.Total() >= t.threshold {
+			t.fired = true
+			hooks = append(hooks, t.hook)
+		}
+	}
+	save := m.file != "" && now.Sub(m.lastSave) >= usageSaveInterval
+	m.Unlock()
+	if save {
+		err := m.save()
+		if err != nil {
+			log.Error().Err(err).Msgf("could not save usage to %s", m.file)
+		}
+	}
+	for _, hook := range hooks {
+		hook(usage)
+	}
+}
+
+func (m *usageMeter) get() Usage {
+	m.Lock()
+	defer m.Unlock()
+	m.resetExpiredCycle(time.Now())
+	return m.usage
+}
+
+// save writes the usage to the usage file, replacing it atomically.
+func (m *usageMeter) save() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.file == "" {
+		return nil
+	}
+	content, err := json.Marshal(m.usage)
+	if err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	err = ioutil.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, m.file)
+	if err != nil {
+		return err
+	}
+	m.lastSave = time.Now()
+	return nil
+}
+
+// segmentOverhead estimates the TCP/IP headers of transferring n payload bytes, including the acknowledgements
+// travelling in the opposite direction.
+func segmentOverhead(n int) int64 {
+	segments := (n + tcpSegmentSize - 1) / tcpSegmentSize
+	return int64(segments * 2 * tcpHeaderSize)
+}
+
+// connUsage accumulates the traffic of a single connection.
+type connUsage struct {
+	sync.Mutex
+	usage ConnUsage
+}
+
+// accountPayload records payload transferred on a connection, both for the connection and for its module.
+func (c Conn) accountPayload(in int, out int) {
+	if in == 0 && out == 0 {
+		return
+	}
+	overhead := segmentOverhead(in) + segmentOverhead(out)
+	if c.usage != nil {
+		c.usage.Lock()
+		c.usage.usage.PayloadIn += int64(in)
+		c.usage.usage.PayloadOut += int64(out)
+		c.usage.usage.ProtocolOverhead += overhead
+		c.usage.Unlock()
+	}
+	c.g.accountTraffic(in, out)
+}
+
+// accountTraffic records payload transferred by the module, along with its estimated TCP/IP overhead.
+func (g *DefaultGsmModule) accountTraffic(in int, out int) {
+	g.usage.add(Usage{
+		PayloadIn:        int64(in),
+		PayloadOut:       int64(out),
+		ProtocolOverhead: segmentOverhead(in) + segmentOverhead(out),
+	})
+}
+
+// accountConnection records the estimated overhead of establishing and tearing down a connection.
+func (c Conn) accountConnection() {
+	c.usage.Lock()
+	c.usage.usage.ProtocolOverhead += tcpConnectionOverhead
+	c.usage.Unlock()
+	c.g.usage.add(Usage{ProtocolOverhead: tcpConnectionOverhead})
+}
+
+// Usage reports the traffic of the connection.
+func (c Conn) Usage() ConnUsage {
+	if c.usage == nil {
+		return ConnUsage{}
+	}
+	c.usage.Lock()
+	defer c.usage.Unlock()
+	return c.usage.usage
+}
+
+// Usage reports the traffic of the module within the current billing cycle.
+func (g *DefaultGsmModule) Usage() Usage {
+	return g.usage.get()
+}
+
+// ResetUsage clears the traffic recorded for the current billing cycle.
+func (g *DefaultGsmModule) ResetUsage() error {
+	g.usage.Lock()
+	g.usage.usage = Usage{Since: time.Now()}
+	for _, t := range g.usage.thresholds {
+		t.fired = false
+	}
+	g.usage.Unlock()
+	return g.usage.save()
+}
+
+// SaveUsage writes the traffic recorded for the current billing cycle to the configured usage file.
+func (g *DefaultGsmModule) SaveUsage() error {
+	return g.usage.save()
+}
+
+// OnUsageThreshold registers a hook that is called once per billing cycle, when the estimated billed traffic
+// reaches the given number of bytes.
+func (g *DefaultGsmModule) OnUsageThreshold(threshold int64, hook func(Usage)) {
+	g.usage.Lock()
+	defer g.usage.Unlock()
+	g.usage.thresholds = append(g.usage.thresholds, &usageThreshold{
+		threshold: threshold,
+		hook:      hook,
+		fired:     g.usage.usage.Total() >= threshold,
+	})
+}